@@ -0,0 +1,868 @@
+package nes
+
+import "math"
+
+// SampleRate is the number of audio samples per second
+// produced by the console.
+const SampleRate = 44100
+
+// when the length counter is loaded, the top 5 bits
+// of the written value are an index into this table
+var lengthTable = [32]byte{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+// the 4 duty cycles of the pulse channels, 12.5%, 25%, 50%
+// and 25% negated
+var dutyTable = [4][8]byte{
+	{0, 1, 0, 0, 0, 0, 0, 0},
+	{0, 1, 1, 0, 0, 0, 0, 0},
+	{0, 1, 1, 1, 1, 0, 0, 0},
+	{1, 0, 0, 1, 1, 1, 1, 1},
+}
+
+// the triangle channel steps through this 32 step sequence
+var triangleTable = [32]byte{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+// noise timer periods in CPU cycles
+var noiseTable = [16]uint16{
+	4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068,
+}
+
+var palNoiseTable = [16]uint16{
+	4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778,
+}
+
+// dmc timer periods in CPU cycles
+var dmcTable = [16]uint16{
+	428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54,
+}
+
+var palDMCTable = [16]uint16{
+	398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50,
+}
+
+// The channels are mixed non-linearly. The two pulse
+// channels share one lookup table and the triangle,
+// noise and dmc channels share another.
+var pulseMixTable [31]float32
+var tndMixTable [203]float32
+
+func init() {
+	for i := range pulseMixTable {
+		pulseMixTable[i] = float32(95.52 / (8128.0/float64(i) + 100))
+	}
+	for i := range tndMixTable {
+		tndMixTable[i] = float32(163.67 / (24329.0/float64(i) + 100))
+	}
+}
+
+const (
+	apuStatusPulse1 = 1 << iota
+	apuStatusPulse2
+	apuStatusTriangle
+	apuStatusNoise
+	apuStatusDMC
+	_
+	apuStatusFrameIRQ
+	apuStatusDMCIRQ
+)
+
+type apu struct {
+	cpu    *cpu
+	timing *regionTiming
+
+	pulse1   pulse
+	pulse2   pulse
+	triangle triangle
+	noise    noise
+	dmc      dmc
+
+	// the frame counter drives the envelopes, sweeps,
+	// length counters and linear counter. It runs either
+	// a 4 step or a 5 step sequence.
+	frameCycle      int
+	frameMode5      bool
+	frameIRQInhibit bool
+	frameIRQ        bool
+
+	// odd cycles clock the pulse timers
+	odd bool
+
+	// every time sampleClock passes the cpu frequency
+	// we output a sample.
+	sampleClock int
+	samples     []float32
+
+	// the output of the NES passes through a couple
+	// of high pass filters and a low pass filter
+	filters [3]filter
+}
+
+func newAPU(cpu *cpu) *apu {
+	a := &apu{
+		cpu: cpu,
+		filters: [3]filter{
+			highPassFilter(SampleRate, 90),
+			highPassFilter(SampleRate, 440),
+			lowPassFilter(SampleRate, 14000),
+		},
+	}
+	a.pulse1.channel = 1
+	a.pulse2.channel = 2
+	a.dmc.cpu = cpu
+	a.noise.shift = 1
+	a.setTiming(ntscTiming)
+	a.dmc.bitsRemaining = 8
+	a.dmc.bufferEmpty = true
+	a.dmc.silence = true
+	return a
+}
+
+func (a *apu) syncState(s *stateStream) {
+	a.pulse1.syncState(s)
+	a.pulse2.syncState(s)
+	a.triangle.syncState(s)
+	a.noise.syncState(s)
+	a.dmc.syncState(s)
+	s.sync(&a.frameCycle, &a.frameMode5, &a.frameIRQInhibit, &a.frameIRQ, &a.odd, &a.sampleClock)
+	for i := range a.filters {
+		s.sync(&a.filters[i].prevX, &a.filters[i].prevY)
+	}
+}
+
+// step the APU a single CPU cycle
+func (a *apu) step() {
+	a.odd = !a.odd
+	if a.odd {
+		a.pulse1.clockTimer()
+		a.pulse2.clockTimer()
+	}
+	a.triangle.clockTimer()
+	a.noise.clockTimer()
+	a.dmc.clockTimer()
+	a.stepFrameCounter()
+
+	a.sampleClock += SampleRate
+	if a.sampleClock >= a.timing.cpuFrequency {
+		a.sampleClock -= a.timing.cpuFrequency
+		a.samples = append(a.samples, a.output())
+	}
+}
+
+// the frame counter timings are in CPU cycles. The 4 step
+// sequence raises the frame interrupt over its last 3 cycles
+// unless inhibited.
+func (a *apu) stepFrameCounter() {
+	a.frameCycle++
+	steps := &a.timing.frameSteps
+	switch a.frameCycle {
+	case steps[0], steps[2]:
+		a.clockQuarterFrame()
+	case steps[1]:
+		a.clockQuarterFrame()
+		a.clockHalfFrame()
+	case steps[3] - 1:
+		if !a.frameMode5 {
+			a.setFrameIRQ()
+		}
+	case steps[3]:
+		if !a.frameMode5 {
+			a.clockQuarterFrame()
+			a.clockHalfFrame()
+			a.setFrameIRQ()
+		}
+	case steps[3] + 1:
+		if !a.frameMode5 {
+			a.setFrameIRQ()
+			a.frameCycle = 0
+		}
+	case steps[4]:
+		a.clockQuarterFrame()
+		a.clockHalfFrame()
+	case steps[4] + 1:
+		a.frameCycle = 0
+	}
+}
+
+// setTiming switches the APU to a region's timing
+func (a *apu) setTiming(timing *regionTiming) {
+	a.timing = timing
+	a.noise.periods = timing.noisePeriods
+	a.dmc.periods = timing.dmcPeriods
+	a.noise.period = a.noise.periods[0] - 1
+	a.dmc.period = a.dmc.periods[0] - 1
+}
+
+func (a *apu) setFrameIRQ() {
+	if a.frameIRQInhibit {
+		return
+	}
+	a.frameIRQ = true
+	a.cpu.assertIRQ(irqFrameCounter)
+}
+
+func (a *apu) clearFrameIRQ() {
+	a.frameIRQ = false
+	a.cpu.releaseIRQ(irqFrameCounter)
+}
+
+// envelopes and the triangle's linear counter
+func (a *apu) clockQuarterFrame() {
+	a.pulse1.envelope.clock()
+	a.pulse2.envelope.clock()
+	a.triangle.clockLinear()
+	a.noise.envelope.clock()
+}
+
+// length counters and sweep units
+func (a *apu) clockHalfFrame() {
+	a.pulse1.clockLength()
+	a.pulse1.clockSweep()
+	a.pulse2.clockLength()
+	a.pulse2.clockSweep()
+	a.triangle.clockLength()
+	a.noise.clockLength()
+}
+
+func (a *apu) output() float32 {
+	p := a.pulse1.output() + a.pulse2.output()
+	tnd := 3*a.triangle.output() + 2*a.noise.output() + a.dmc.output()
+	value := pulseMixTable[p] + tndMixTable[tnd]
+	for i := range a.filters {
+		value = a.filters[i].step(value)
+	}
+	return value
+}
+
+// reading the status reports which length counters are
+// active and which interrupts are pending. It also
+// acknowledges the frame interrupt.
+func (a *apu) readStatus() byte {
+	var value byte
+	if a.pulse1.length > 0 {
+		value |= apuStatusPulse1
+	}
+	if a.pulse2.length > 0 {
+		value |= apuStatusPulse2
+	}
+	if a.triangle.length > 0 {
+		value |= apuStatusTriangle
+	}
+	if a.noise.length > 0 {
+		value |= apuStatusNoise
+	}
+	if a.dmc.bytesRemaining > 0 {
+		value |= apuStatusDMC
+	}
+	if a.frameIRQ {
+		value |= apuStatusFrameIRQ
+	}
+	if a.dmc.irq {
+		value |= apuStatusDMCIRQ
+	}
+	a.clearFrameIRQ()
+	return value
+}
+
+func (a *apu) writeRegister(address uint16, value byte) {
+	switch address {
+	case 0x4000:
+		a.pulse1.writeControl(value)
+	case 0x4001:
+		a.pulse1.writeSweep(value)
+	case 0x4002:
+		a.pulse1.writeTimerLow(value)
+	case 0x4003:
+		a.pulse1.writeTimerHigh(value)
+	case 0x4004:
+		a.pulse2.writeControl(value)
+	case 0x4005:
+		a.pulse2.writeSweep(value)
+	case 0x4006:
+		a.pulse2.writeTimerLow(value)
+	case 0x4007:
+		a.pulse2.writeTimerHigh(value)
+	case 0x4008:
+		a.triangle.writeControl(value)
+	case 0x400A:
+		a.triangle.writeTimerLow(value)
+	case 0x400B:
+		a.triangle.writeTimerHigh(value)
+	case 0x400C:
+		a.noise.writeControl(value)
+	case 0x400E:
+		a.noise.writePeriod(value)
+	case 0x400F:
+		a.noise.writeLength(value)
+	case 0x4010:
+		a.dmc.writeControl(value)
+	case 0x4011:
+		a.dmc.writeValue(value)
+	case 0x4012:
+		a.dmc.writeAddress(value)
+	case 0x4013:
+		a.dmc.writeLength(value)
+	case 0x4015:
+		a.writeStatus(value)
+	case 0x4017:
+		a.writeFrameCounter(value)
+	}
+}
+
+// writing to the status register enables and disables
+// each channel. A disabled channel has its length counter
+// forced to zero. It also acknowledges the DMC interrupt.
+func (a *apu) writeStatus(value byte) {
+	a.dmc.clearIRQ()
+	a.pulse1.setEnabled(isAnySet(value, apuStatusPulse1))
+	a.pulse2.setEnabled(isAnySet(value, apuStatusPulse2))
+	a.triangle.setEnabled(isAnySet(value, apuStatusTriangle))
+	a.noise.setEnabled(isAnySet(value, apuStatusNoise))
+	a.dmc.setEnabled(isAnySet(value, apuStatusDMC))
+}
+
+// writing to the frame counter restarts the sequence.
+// In 5 step mode the quarter and half frame units are
+// clocked immediately. Setting the inhibit flag also
+// acknowledges the frame interrupt.
+func (a *apu) writeFrameCounter(value byte) {
+	a.frameMode5 = isAnySet(value, 0x80)
+	a.frameIRQInhibit = isAnySet(value, 0x40)
+	if a.frameIRQInhibit {
+		a.clearFrameIRQ()
+	}
+	a.frameCycle = 0
+	if a.frameMode5 {
+		a.clockQuarterFrame()
+		a.clockHalfFrame()
+	}
+}
+
+// envelope is shared by the pulse and noise channels.
+// It either outputs a constant volume or a sawtooth
+// that decays from 15 to 0, optionally looping.
+type envelope struct {
+	start    bool
+	loop     bool
+	constant bool
+	volume   byte
+	divider  byte
+	decay    byte
+}
+
+func (e *envelope) syncState(s *stateStream) {
+	s.sync(&e.start, &e.loop, &e.constant, &e.volume, &e.divider, &e.decay)
+}
+
+func (e *envelope) write(value byte) {
+	e.loop = isAnySet(value, 0x20)
+	e.constant = isAnySet(value, 0x10)
+	e.volume = value & 0x0F
+}
+
+func (e *envelope) clock() {
+	if e.start {
+		e.start = false
+		e.decay = 15
+		e.divider = e.volume
+		return
+	}
+	if e.divider > 0 {
+		e.divider--
+		return
+	}
+	e.divider = e.volume
+	if e.decay > 0 {
+		e.decay--
+	} else if e.loop {
+		e.decay = 15
+	}
+}
+
+func (e *envelope) output() byte {
+	if e.constant {
+		return e.volume
+	}
+	return e.decay
+}
+
+type pulse struct {
+	// channel 1 and 2 negate their sweep differently
+	channel byte
+	enabled bool
+
+	duty      byte
+	dutyIndex byte
+	envelope  envelope
+
+	// the envelope loop flag doubles as the
+	// length counter halt flag
+	length byte
+
+	period uint16
+	timer  uint16
+
+	sweepEnabled bool
+	sweepPeriod  byte
+	sweepNegate  bool
+	sweepShift   byte
+	sweepReload  bool
+	sweepDivider byte
+}
+
+func (p *pulse) syncState(s *stateStream) {
+	s.sync(&p.enabled, &p.duty, &p.dutyIndex, &p.length, &p.period, &p.timer)
+	s.sync(&p.sweepEnabled, &p.sweepPeriod, &p.sweepNegate, &p.sweepShift, &p.sweepReload, &p.sweepDivider)
+	p.envelope.syncState(s)
+}
+
+// $4000/$4004 DDLC VVVV
+func (p *pulse) writeControl(value byte) {
+	p.duty = value >> 6
+	p.envelope.write(value)
+}
+
+// $4001/$4005 EPPP NSSS
+func (p *pulse) writeSweep(value byte) {
+	p.sweepEnabled = isAnySet(value, 0x80)
+	p.sweepPeriod = (value >> 4) & 7
+	p.sweepNegate = isAnySet(value, 0x08)
+	p.sweepShift = value & 7
+	p.sweepReload = true
+}
+
+// $4002/$4006 LLLL LLLL
+func (p *pulse) writeTimerLow(value byte) {
+	p.period = (p.period & 0x0700) | uint16(value)
+}
+
+// $4003/$4007 LLLL LHHH
+func (p *pulse) writeTimerHigh(value byte) {
+	p.period = (p.period & 0x00FF) | (uint16(value&7) << 8)
+	if p.enabled {
+		p.length = lengthTable[value>>3]
+	}
+	p.dutyIndex = 0
+	p.envelope.start = true
+}
+
+func (p *pulse) setEnabled(enabled bool) {
+	p.enabled = enabled
+	if !enabled {
+		p.length = 0
+	}
+}
+
+func (p *pulse) clockTimer() {
+	if p.timer == 0 {
+		p.timer = p.period
+		p.dutyIndex = (p.dutyIndex + 1) & 7
+	} else {
+		p.timer--
+	}
+}
+
+func (p *pulse) clockLength() {
+	if p.length > 0 && !p.envelope.loop {
+		p.length--
+	}
+}
+
+// the sweep unit continuously calculates a target period
+// pulse 1 uses ones' complement when negating and pulse 2
+// uses twos' complement.
+func (p *pulse) targetPeriod() uint16 {
+	change := p.period >> p.sweepShift
+	if !p.sweepNegate {
+		return p.period + change
+	}
+	if p.channel == 1 {
+		change++
+	}
+	if change > p.period {
+		return 0
+	}
+	return p.period - change
+}
+
+// the channel is silenced when the period is too small
+// or the sweep would push the period out of range, even
+// if the sweep unit is disabled.
+func (p *pulse) muted() bool {
+	return p.period < 8 || p.targetPeriod() > 0x7FF
+}
+
+func (p *pulse) clockSweep() {
+	if p.sweepDivider == 0 && p.sweepEnabled && p.sweepShift > 0 && !p.muted() {
+		p.period = p.targetPeriod()
+	}
+	if p.sweepDivider == 0 || p.sweepReload {
+		p.sweepDivider = p.sweepPeriod
+		p.sweepReload = false
+	} else {
+		p.sweepDivider--
+	}
+}
+
+func (p *pulse) output() byte {
+	if p.length == 0 || p.muted() || dutyTable[p.duty][p.dutyIndex] == 0 {
+		return 0
+	}
+	return p.envelope.output()
+}
+
+type triangle struct {
+	enabled bool
+
+	// control doubles as the length counter halt flag
+	control bool
+	length  byte
+
+	linearReloadValue byte
+	linearReload      bool
+	linear            byte
+
+	period   uint16
+	timer    uint16
+	sequence byte
+}
+
+func (t *triangle) syncState(s *stateStream) {
+	s.sync(&t.enabled, &t.control, &t.length, &t.linearReloadValue, &t.linearReload, &t.linear)
+	s.sync(&t.period, &t.timer, &t.sequence)
+}
+
+// $4008 CRRR RRRR
+func (t *triangle) writeControl(value byte) {
+	t.control = isAnySet(value, 0x80)
+	t.linearReloadValue = value & 0x7F
+}
+
+// $400A LLLL LLLL
+func (t *triangle) writeTimerLow(value byte) {
+	t.period = (t.period & 0x0700) | uint16(value)
+}
+
+// $400B LLLL LHHH
+func (t *triangle) writeTimerHigh(value byte) {
+	t.period = (t.period & 0x00FF) | (uint16(value&7) << 8)
+	if t.enabled {
+		t.length = lengthTable[value>>3]
+	}
+	t.linearReload = true
+}
+
+func (t *triangle) setEnabled(enabled bool) {
+	t.enabled = enabled
+	if !enabled {
+		t.length = 0
+	}
+}
+
+// the sequencer only advances when both the
+// length counter and linear counter are non zero
+func (t *triangle) clockTimer() {
+	if t.timer == 0 {
+		t.timer = t.period
+		if t.length > 0 && t.linear > 0 {
+			t.sequence = (t.sequence + 1) & 31
+		}
+	} else {
+		t.timer--
+	}
+}
+
+func (t *triangle) clockLinear() {
+	if t.linearReload {
+		t.linear = t.linearReloadValue
+	} else if t.linear > 0 {
+		t.linear--
+	}
+	if !t.control {
+		t.linearReload = false
+	}
+}
+
+func (t *triangle) clockLength() {
+	if t.length > 0 && !t.control {
+		t.length--
+	}
+}
+
+func (t *triangle) output() byte {
+	return triangleTable[t.sequence]
+}
+
+type noise struct {
+	enabled bool
+
+	envelope envelope
+	length   byte
+
+	// in mode 1 the feedback comes from bit 6
+	// rather than bit 1 producing a shorter
+	// metallic sounding sequence.
+	mode    bool
+	shift   uint16
+	periods *[16]uint16
+	period  uint16
+	timer   uint16
+}
+
+func (n *noise) syncState(s *stateStream) {
+	s.sync(&n.enabled, &n.length, &n.mode, &n.shift, &n.period, &n.timer)
+	n.envelope.syncState(s)
+}
+
+// $400C --LC VVVV
+func (n *noise) writeControl(value byte) {
+	n.envelope.write(value)
+}
+
+// $400E M--- PPPP
+func (n *noise) writePeriod(value byte) {
+	n.mode = isAnySet(value, 0x80)
+	n.period = n.periods[value&0x0F] - 1
+}
+
+// $400F LLLL L---
+func (n *noise) writeLength(value byte) {
+	if n.enabled {
+		n.length = lengthTable[value>>3]
+	}
+	n.envelope.start = true
+}
+
+func (n *noise) setEnabled(enabled bool) {
+	n.enabled = enabled
+	if !enabled {
+		n.length = 0
+	}
+}
+
+func (n *noise) clockTimer() {
+	if n.timer > 0 {
+		n.timer--
+		return
+	}
+	n.timer = n.period
+	bit := uint16(1)
+	if n.mode {
+		bit = 6
+	}
+	feedback := (n.shift & 1) ^ ((n.shift >> bit) & 1)
+	n.shift = (n.shift >> 1) | (feedback << 14)
+}
+
+func (n *noise) clockLength() {
+	if n.length > 0 && !n.envelope.loop {
+		n.length--
+	}
+}
+
+func (n *noise) output() byte {
+	if n.length == 0 || n.shift&1 == 1 {
+		return 0
+	}
+	return n.envelope.output()
+}
+
+// dmc plays back 1 bit delta encoded samples read
+// directly from CPU memory.
+type dmc struct {
+	cpu *cpu
+
+	irqEnabled bool
+	irq        bool
+	loop       bool
+	periods    *[16]uint16
+	period     uint16
+	timer      uint16
+
+	// 7 bit output level
+	value byte
+
+	sampleAddress  uint16
+	sampleLength   uint16
+	currentAddress uint16
+	bytesRemaining uint16
+
+	// the sample buffer is filled by the memory
+	// reader and emptied into the shift register
+	buffer      byte
+	bufferEmpty bool
+
+	shift         byte
+	bitsRemaining byte
+	silence       bool
+}
+
+func (d *dmc) syncState(s *stateStream) {
+	s.sync(&d.irqEnabled, &d.irq, &d.loop, &d.period, &d.timer, &d.value)
+	s.sync(&d.sampleAddress, &d.sampleLength, &d.currentAddress, &d.bytesRemaining)
+	s.sync(&d.buffer, &d.bufferEmpty, &d.shift, &d.bitsRemaining, &d.silence)
+}
+
+// $4010 IL-- RRRR
+func (d *dmc) writeControl(value byte) {
+	d.irqEnabled = isAnySet(value, 0x80)
+	if !d.irqEnabled {
+		d.clearIRQ()
+	}
+	d.loop = isAnySet(value, 0x40)
+	d.period = d.periods[value&0x0F] - 1
+}
+
+// $4011 -DDD DDDD
+func (d *dmc) writeValue(value byte) {
+	d.value = value & 0x7F
+}
+
+// $4012 AAAA AAAA
+// sample address = %11AAAAAA.AA000000
+func (d *dmc) writeAddress(value byte) {
+	d.sampleAddress = 0xC000 | uint16(value)<<6
+}
+
+// $4013 LLLL LLLL
+// sample length = %LLLL.LLLL0001
+func (d *dmc) writeLength(value byte) {
+	d.sampleLength = uint16(value)<<4 | 1
+}
+
+func (d *dmc) clearIRQ() {
+	d.irq = false
+	d.cpu.releaseIRQ(irqDMC)
+}
+
+func (d *dmc) setEnabled(enabled bool) {
+	if !enabled {
+		d.bytesRemaining = 0
+		return
+	}
+	if d.bytesRemaining == 0 {
+		d.restart()
+		d.fillBuffer()
+	}
+}
+
+func (d *dmc) restart() {
+	d.currentAddress = d.sampleAddress
+	d.bytesRemaining = d.sampleLength
+}
+
+// the memory reader asks the cpu for a DMA to fill the
+// sample buffer whenever it is empty and there are
+// bytes remaining
+func (d *dmc) fillBuffer() {
+	if !d.bufferEmpty || d.bytesRemaining == 0 {
+		return
+	}
+	d.cpu.requestDMC()
+}
+
+// loadBuffer is given the byte read by the DMA, unless the
+// channel was disabled in the meantime. Finishing a sample
+// that doesn't loop raises the DMC interrupt.
+func (d *dmc) loadBuffer(value byte) {
+	if !d.bufferEmpty || d.bytesRemaining == 0 {
+		return
+	}
+	d.buffer = value
+	d.bufferEmpty = false
+	// the address wraps around to $8000
+	if d.currentAddress == 0xFFFF {
+		d.currentAddress = 0x8000
+	} else {
+		d.currentAddress++
+	}
+	d.bytesRemaining--
+	if d.bytesRemaining == 0 {
+		if d.loop {
+			d.restart()
+		} else if d.irqEnabled {
+			d.irq = true
+			d.cpu.assertIRQ(irqDMC)
+		}
+	}
+}
+
+func (d *dmc) clockTimer() {
+	d.fillBuffer()
+	if d.timer > 0 {
+		d.timer--
+		return
+	}
+	d.timer = d.period
+	d.clockOutput()
+}
+
+// each output clock adds or subtracts 2 from the output
+// level depending on the next bit in the shift register
+func (d *dmc) clockOutput() {
+	if !d.silence {
+		if d.shift&1 == 1 {
+			if d.value <= 125 {
+				d.value += 2
+			}
+		} else {
+			if d.value >= 2 {
+				d.value -= 2
+			}
+		}
+	}
+	d.shift >>= 1
+	d.bitsRemaining--
+	if d.bitsRemaining == 0 {
+		d.bitsRemaining = 8
+		if d.bufferEmpty {
+			d.silence = true
+		} else {
+			d.silence = false
+			d.shift = d.buffer
+			d.bufferEmpty = true
+		}
+	}
+}
+
+func (d *dmc) output() byte {
+	return d.value
+}
+
+// filter is a first order IIR filter
+type filter struct {
+	b0, b1, a1   float32
+	prevX, prevY float32
+}
+
+func lowPassFilter(sampleRate, cutoff float64) filter {
+	c := sampleRate / math.Pi / cutoff
+	a0i := 1 / (1 + c)
+	return filter{
+		b0: float32(a0i),
+		b1: float32(a0i),
+		a1: float32((1 - c) * a0i),
+	}
+}
+
+func highPassFilter(sampleRate, cutoff float64) filter {
+	c := sampleRate / math.Pi / cutoff
+	a0i := 1 / (1 + c)
+	return filter{
+		b0: float32(c * a0i),
+		b1: float32(-c * a0i),
+		a1: float32((1 - c) * a0i),
+	}
+}
+
+func (f *filter) step(x float32) float32 {
+	y := f.b0*x + f.b1*f.prevX - f.a1*f.prevY
+	f.prevX = x
+	f.prevY = y
+	return y
+}
@@ -0,0 +1,73 @@
+package nes
+
+import "testing"
+
+func TestAPULengthCounter(t *testing.T) {
+	a := newAPU(&cpu{})
+
+	// writes to a disabled channel don't load the length counter
+	a.writeRegister(0x4003, 0x08)
+	if status := a.readStatus(); status != 0 {
+		t.Fatalf("status = %02X, want 00", status)
+	}
+
+	a.writeRegister(0x4015, apuStatusPulse1|apuStatusNoise)
+	// length index 1 is 254
+	a.writeRegister(0x4003, 0x08)
+	// length index 3 is 2
+	a.writeRegister(0x400F, 0x18)
+	if status := a.readStatus(); status != apuStatusPulse1|apuStatusNoise {
+		t.Fatalf("status = %02X, want %02X", status, apuStatusPulse1|apuStatusNoise)
+	}
+
+	// two half frames in 4 step mode silence the noise channel
+	a.writeRegister(0x4017, 0x40)
+	for i := 0; i < 29829; i++ {
+		a.step()
+	}
+	if status := a.readStatus(); status != apuStatusPulse1 {
+		t.Fatalf("status = %02X, want %02X", status, apuStatusPulse1)
+	}
+	if a.pulse1.length != 252 {
+		t.Fatalf("pulse1 length = %d, want 252", a.pulse1.length)
+	}
+
+	// disabling the channel clears the length counter
+	a.writeRegister(0x4015, 0)
+	if status := a.readStatus(); status != 0 {
+		t.Fatalf("status = %02X, want 00", status)
+	}
+}
+
+func TestAPUFrameIRQ(t *testing.T) {
+	c := &cpu{}
+	a := newAPU(c)
+
+	for i := 0; i < 29827; i++ {
+		a.step()
+	}
+	if c.irqLine != 0 {
+		t.Fatalf("irq asserted early at cycle %d", a.frameCycle)
+	}
+	a.step()
+	if c.irqLine != irqFrameCounter {
+		t.Fatalf("irqLine = %02X, want %02X", c.irqLine, irqFrameCounter)
+	}
+
+	// reading the status acknowledges the interrupt
+	if status := a.readStatus(); status != apuStatusFrameIRQ {
+		t.Fatalf("status = %02X, want %02X", status, apuStatusFrameIRQ)
+	}
+	if c.irqLine != 0 || a.readStatus() != 0 {
+		t.Fatal("frame irq not acknowledged")
+	}
+
+	// 5 step mode never interrupts
+	a.writeRegister(0x4017, 0x80)
+	for i := 0; i < 2*37282; i++ {
+		a.step()
+	}
+	if c.irqLine != 0 {
+		t.Fatal("frame irq asserted in 5 step mode")
+	}
+}
@@ -22,38 +22,116 @@ package nes
 // 	return 0
 // }
 
-import "log"
+import "github.com/pkg/errors"
 
 type cartridge interface {
 	readByte(address uint16) byte
 	write(address uint16, value byte)
+	// mapped reports whether the cartridge drives the
+	// cpu data bus when address is read. Reads of PRG RAM
+	// the board doesn't have are open bus.
+	mapped(address uint16) bool
 	mirror(address uint16) uint16
+	// fault returns the last illegal access
+	// made to the cartridge if any
+	fault() error
+	// clearFault forgets the illegal access, e.g.
+	// when an earlier state is loaded
+	clearFault()
+	// syncState saves or restores the bank
+	// registers and any RAM on the cartridge
+	syncState(s *stateStream)
+	// prgRAM is the RAM at $6000-$7FFF which may
+	// be battery backed. It is empty if the board
+	// doesn't have any.
+	prgRAM() []byte
 }
 
-func newCart(mapper, mirror byte, prg, chr []byte) cartridge {
-	switch mapper {
+// cpuCartridge is implemented by mappers that need the
+// cpu, to raise interrupts or to see which cycle it's on
+type cpuCartridge interface {
+	connectCPU(c *cpu)
+}
+
+// expansionCartridge is implemented by mappers with
+// hardware in the expansion area at $4020-$5FFF. Other
+// boards leave it as open bus.
+type expansionCartridge interface {
+	readExpansion(address uint16) byte
+	writeExpansion(address uint16, value byte)
+}
+
+// ppuBusObserver is implemented by mappers that watch
+// the PPU address bus, e.g. to clock a scanline counter
+// off of A12 or to switch banks when a tile is fetched.
+// ppuAddress is called for every address the PPU puts
+// on its bus, in hardware order, along with the PPU's
+// running cycle count.
+type ppuBusObserver interface {
+	ppuAddress(address uint16, clock uint64)
+}
+
+func newCart(info *CartridgeInfo, prg, chr []byte) (cartridge, error) {
+	// the supported boards fix or switch PRG in 16k banks,
+	// or 8k banks with the last 16k fixed, and CHR ROM is
+	// at least the 8k pattern tables
+	if len(prg)%0x4000 != 0 {
+		return nil, errors.Errorf("unsupported PRG ROM size %d for mapper %d", len(prg), info.Mapper)
+	}
+	if info.CHRROMSize%0x2000 != 0 {
+		return nil, errors.Errorf("unsupported CHR ROM size %d for mapper %d", info.CHRROMSize, info.Mapper)
+	}
+	mirror := byte(info.Mirroring)
+	// volatile and battery backed RAM share $6000-$7FFF
+	size := info.PRGRAMSize + info.PRGNVRAMSize
+	// trainers need RAM at $7000
+	if info.Trainer && size < 0x2000 {
+		size = 0x2000
+	}
+	sram := make([]byte, size)
+	// writes to CHR ROM are ignored
+	chrRAM := info.CHRROMSize == 0
+	switch info.Mapper {
 	case 0:
 		return &nROM{
 			mirrorMode: mirror,
 			prg:        prg,
 			chr:        chr,
-		}
+			chrRAM:     chrRAM,
+			sram:       sram,
+		}, nil
 	case 1:
-		return newMMC1(mirror, prg, chr)
+		m := newMMC1(mirror, prg, chr, sram)
+		m.chrRAM = chrRAM
+		return m, nil
 	case 2:
+		// the bank register is 8 bits
+		if len(prg) > 256*0x4000 {
+			return nil, errors.Errorf("unsupported PRG ROM size %d for mapper %d", len(prg), info.Mapper)
+		}
 		return &unROM{
 			mirrorMode: mirror,
 			prg:        prg,
 			chr:        chr,
-		}
+			chrRAM:     chrRAM,
+			sram:       sram,
+		}, nil
 	case 3:
+		// only 2 bits of the bank register are used
+		if len(chr) > 4*0x2000 {
+			return nil, errors.Errorf("unsupported CHR ROM size %d for mapper %d", len(chr), info.Mapper)
+		}
 		return &cnROM{
 			mirrorMode: mirror,
 			prg:        prg,
 			chr:        chr,
-		}
-	default:
-		log.Fatalf("unsupported mapper %d", mapper)
+			chrRAM:     chrRAM,
+			sram:       sram,
+		}, nil
+	case 4:
+		m := newMMC3(mirror, prg, chr, sram)
+		m.chrRAM = chrRAM
+		return m, nil
 	}
-	return nil
+	return nil, errors.Errorf("unsupported mapper %d", info.Mapper)
 }
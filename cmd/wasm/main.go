@@ -2,6 +2,9 @@ package main
 
 import (
 	"bytes"
+	"encoding/base64"
+	"fmt"
+	"hash/crc32"
 	"image"
 	"syscall/js"
 	"time"
@@ -9,6 +12,10 @@ import (
 	"github.com/natessilva/nes"
 )
 
+// how many frames between checking if the
+// battery backed RAM needs to be persisted
+const batteryInterval = 60
+
 func renderLoop(fn func()) {
 	ticker := time.Tick(time.Second / 60)
 	for range ticker {
@@ -29,18 +36,127 @@ func main() {
 
 	imgData := ctx.Call("createImageData", width, height)
 
+	// battery backed RAM is kept in local storage
+	// keyed by the checksum of the ROM
+	localStorage := js.Global().Get("localStorage")
+	var batteryKey string
+	var battery []byte
+	frames := 0
+	// PAL and Dendy games run at 50 frames per second
+	// so some ticks of the render loop are skipped
+	frameBudget := 0.0
+
+	// the palette picked on the page
+	palette := nes.DefaultPalette()
+	usePalette := func(p *nes.Palette) {
+		palette = p
+		if console != nil {
+			console.SetPalette(palette)
+		}
+	}
+	js.Global().Set("setPalette", js.FuncOf(func(this js.Value, inputs []js.Value) interface{} {
+		switch inputs[0].String() {
+		case "ntsc":
+			usePalette(nes.GeneratePalette(nes.DefaultNTSCParameters))
+		default:
+			usePalette(nes.DefaultPalette())
+		}
+		return nil
+	}))
+	js.Global().Set("loadPalette", js.FuncOf(func(this js.Value, inputs []js.Value) interface{} {
+		fileArr := inputs[0]
+		inBuf := make([]byte, fileArr.Get("byteLength").Int())
+		js.CopyBytesToGo(inBuf, fileArr)
+		p, err := nes.ReadPalette(bytes.NewReader(inBuf))
+		if err != nil {
+			js.Global().Call("alert", "Unable to load palette: "+err.Error())
+			return nil
+		}
+		usePalette(p)
+		return nil
+	}))
+
+	// the Zapper goes in port 2 when enabled
+	var zapper *nes.Zapper
+	zapperEnabled := false
+	plugZapper := func() {
+		if console == nil {
+			return
+		}
+		if zapperEnabled {
+			zapper = console.NewZapper()
+			console.SetInputDevice(nes.Port2, zapper)
+		} else {
+			// put player 2's joypad back
+			zapper = nil
+			console.SetMultitap(nes.MultitapNone)
+		}
+	}
+	js.Global().Set("setZapper", js.FuncOf(func(this js.Value, inputs []js.Value) interface{} {
+		zapperEnabled = inputs[0].Bool()
+		plugZapper()
+		return nil
+	}))
+	js.Global().Set("aimZapper", js.FuncOf(func(this js.Value, inputs []js.Value) interface{} {
+		if zapper != nil {
+			zapper.Aim(inputs[0].Int(), inputs[1].Int())
+		}
+		return nil
+	}))
+	js.Global().Set("triggerZapper", js.FuncOf(func(this js.Value, inputs []js.Value) interface{} {
+		if zapper != nil {
+			zapper.SetTrigger(inputs[0].Bool())
+		}
+		return nil
+	}))
+
+	saveBattery := func() {
+		if console == nil || !console.HasBattery() {
+			return
+		}
+		var buf bytes.Buffer
+		if err := console.SaveBattery(&buf); err != nil {
+			return
+		}
+		if bytes.Equal(buf.Bytes(), battery) {
+			return
+		}
+		battery = buf.Bytes()
+		localStorage.Call("setItem", batteryKey, base64.StdEncoding.EncodeToString(battery))
+	}
+	js.Global().Set("saveBattery", js.FuncOf(func(this js.Value, inputs []js.Value) interface{} {
+		saveBattery()
+		return nil
+	}))
+
 	loadROM := func(this js.Value, inputs []js.Value) interface{} {
 		fileArr := inputs[0]
 		inBuf := make([]byte, fileArr.Get("byteLength").Int())
 		js.CopyBytesToGo(inBuf, fileArr)
 		r := bytes.NewReader(inBuf)
 
-		// TODO error handling
-		c, err := nes.NewConsole(r)
+		c, err := nes.NewConsole(r, nes.WithPalette(palette))
 		if err != nil {
+			js.Global().Call("alert", "Unable to load ROM: "+err.Error())
 			return nil
 		}
+		// persist the previous game before switching
+		saveBattery()
+		batteryKey = fmt.Sprintf("nes-battery-%08x", crc32.ChecksumIEEE(inBuf))
+		battery = nil
+		if c.HasBattery() {
+			saved := localStorage.Call("getItem", batteryKey)
+			if !saved.IsNull() {
+				data, err := base64.StdEncoding.DecodeString(saved.String())
+				if err == nil && c.LoadBattery(bytes.NewReader(data)) == nil {
+					battery = data
+				}
+			}
+		}
 		console = c
+		if zapperEnabled {
+			plugZapper()
+		}
 		return nil
 	}
 	js.Global().Set("loadROM", js.FuncOf(loadROM))
@@ -49,7 +165,22 @@ func main() {
 		if console == nil {
 			return
 		}
+		frameBudget += console.FrameRate() / 60
+		if frameBudget < 1 {
+			return
+		}
+		frameBudget--
 		console.RenderFrame(image)
+		frames++
+		if frames%batteryInterval == 0 {
+			saveBattery()
+		}
+		if console.Halted() {
+			js.Global().Call("alert", "Emulation halted: "+console.Err().Error())
+			saveBattery()
+			console = nil
+			return
+		}
 		js.CopyBytesToJS(imgData.Get("data"), image.Pix)
 		ctx.Call("putImageData", imgData, 0, 0)
 	})
@@ -60,21 +191,21 @@ func main() {
 		}
 		switch inputs[0].String() {
 		case "Enter":
-			console.SetJoypad(nes.ButtonStart, true)
+			console.SetJoypad(nes.Player1, nes.ButtonStart, true)
 		case "f":
-			console.SetJoypad(nes.ButtonA, true)
+			console.SetJoypad(nes.Player1, nes.ButtonA, true)
 		case "d":
-			console.SetJoypad(nes.ButtonB, true)
+			console.SetJoypad(nes.Player1, nes.ButtonB, true)
 		case " ":
-			console.SetJoypad(nes.ButtonSelect, true)
+			console.SetJoypad(nes.Player1, nes.ButtonSelect, true)
 		case "ArrowUp":
-			console.SetJoypad(nes.ButtonUp, true)
+			console.SetJoypad(nes.Player1, nes.ButtonUp, true)
 		case "ArrowDown":
-			console.SetJoypad(nes.ButtonDown, true)
+			console.SetJoypad(nes.Player1, nes.ButtonDown, true)
 		case "ArrowLeft":
-			console.SetJoypad(nes.ButtonLeft, true)
+			console.SetJoypad(nes.Player1, nes.ButtonLeft, true)
 		case "ArrowRight":
-			console.SetJoypad(nes.ButtonRight, true)
+			console.SetJoypad(nes.Player1, nes.ButtonRight, true)
 		default:
 			return false
 		}
@@ -88,21 +219,21 @@ func main() {
 		}
 		switch inputs[0].String() {
 		case "Enter":
-			console.SetJoypad(nes.ButtonStart, false)
+			console.SetJoypad(nes.Player1, nes.ButtonStart, false)
 		case "f":
-			console.SetJoypad(nes.ButtonA, false)
+			console.SetJoypad(nes.Player1, nes.ButtonA, false)
 		case "d":
-			console.SetJoypad(nes.ButtonB, false)
+			console.SetJoypad(nes.Player1, nes.ButtonB, false)
 		case " ":
-			console.SetJoypad(nes.ButtonSelect, false)
+			console.SetJoypad(nes.Player1, nes.ButtonSelect, false)
 		case "ArrowUp":
-			console.SetJoypad(nes.ButtonUp, false)
+			console.SetJoypad(nes.Player1, nes.ButtonUp, false)
 		case "ArrowDown":
-			console.SetJoypad(nes.ButtonDown, false)
+			console.SetJoypad(nes.Player1, nes.ButtonDown, false)
 		case "ArrowLeft":
-			console.SetJoypad(nes.ButtonLeft, false)
+			console.SetJoypad(nes.Player1, nes.ButtonLeft, false)
 		case "ArrowRight":
-			console.SetJoypad(nes.ButtonRight, false)
+			console.SetJoypad(nes.Player1, nes.ButtonRight, false)
 		default:
 			return false
 		}
@@ -1,15 +1,21 @@
 package nes
 
-import "log"
-
 type cnROM struct {
 	mirrorMode byte
 	prg        []byte
 	chr        []byte
+	// boards without CHR ROM have RAM instead
+	chrRAM bool
+	// some boards have PRG RAM
+	sram []byte
 
 	chrBank byte
 }
 
+func (n *cnROM) prgRAM() []byte {
+	return n.sram
+}
+
 func (n *cnROM) readByte(address uint16) byte {
 	switch {
 	case address < 0x2000:
@@ -17,23 +23,40 @@ func (n *cnROM) readByte(address uint16) byte {
 	case address >= 0x8000:
 		index := int(address - 0x8000)
 		return n.prg[index%len(n.prg)]
-	default:
-		log.Fatalf("invalid read address %04X", address)
+	case address >= 0x6000 && len(n.sram) > 0:
+		return n.sram[int(address-0x6000)%len(n.sram)]
 	}
 	return 0
 }
 
+func (n *cnROM) mapped(address uint16) bool {
+	return address >= 0x8000 || address >= 0x6000 && len(n.sram) > 0
+}
+
 func (n *cnROM) write(address uint16, value byte) {
 	switch {
 	case address < 0x2000:
-		n.chr[int(n.chrBank)*0x2000+int(address)] = value
+		if n.chrRAM {
+			n.chr[int(n.chrBank)*0x2000+int(address)] = value
+		}
 	case address >= 0x8000:
-		n.chrBank = value & 3
-	default:
-		log.Fatalf("invalid write address %04X", address)
+		// smaller boards ignore the upper bank bits
+		n.chrBank = byte(int(value&3) % (len(n.chr) / 0x2000))
+	case address >= 0x6000 && len(n.sram) > 0:
+		n.sram[int(address-0x6000)%len(n.sram)] = value
 	}
 }
 
+func (n *cnROM) syncState(s *stateStream) {
+	s.sync(n.chr, n.sram, &n.chrBank)
+}
+
 func (n *cnROM) mirror(address uint16) uint16 {
 	return mirror(n.mirrorMode, address)
 }
+
+func (n *cnROM) fault() error {
+	return nil
+}
+
+func (n *cnROM) clearFault() {}
@@ -1,53 +1,352 @@
 package nes
 
 import (
+	"bytes"
+	"hash/crc32"
 	"image"
 	"io"
+
+	"github.com/pkg/errors"
 )
 
 type Console struct {
-	ppu     *ppu
-	cpu     *cpu
-	joypad1 *joypad
+	cart cartridge
+	ppu  *ppu
+	cpu  *cpu
+	apu  *apu
+	// the joypads plugged in by default. Joypads 3
+	// and 4 are only connected through the multitap.
+	joypads  [4]*joypad
+	multitap *multitap
+
+	// CRC32 of the ROM file, save states can only
+	// be loaded into the same game.
+	checksum uint32
+
+	info *CartridgeInfo
+
+	region Region
+	// set by WithRegion, which overrides the database
+	regionForced bool
+	timing       *regionTiming
+	// PAL runs 16 PPU dots every 5 CPU cycles, dots
+	// counts them in fifths
+	dots int
+
+	// nil unless the cartridge has battery backed RAM
+	battery []byte
+
+	// where the PPU draws the current frame
+	image *image.RGBA
+
+	// the fault that halted the console
+	err error
+}
+
+// Option configures a Console when it's created
+type Option func(c *Console)
+
+// WithRegion runs the console with the timing of region
+// rather than the one from the ROM's header or database
+func WithRegion(region Region) Option {
+	return func(c *Console) {
+		c.regionForced = true
+		c.setRegion(region)
+	}
+}
+
+// WithRegionDatabase looks the ROM up in db by
+// CartridgeInfo.CRC32 when it has an iNES 1.0 header,
+// which rarely gives the region. NES 2.0 headers are
+// trusted, and WithRegion overrides it.
+func WithRegionDatabase(db map[uint32]Region) Option {
+	return func(c *Console) {
+		if c.regionForced || c.info.NES2 {
+			return
+		}
+		if region, ok := db[c.info.CRC32]; ok {
+			c.setRegion(region)
+		}
+	}
 }
 
-func NewConsole(r io.Reader) (*Console, error) {
+// WithPalette renders with the palette p instead of
+// the default one. A nil p keeps the default.
+func WithPalette(p *Palette) Option {
+	return func(c *Console) {
+		c.SetPalette(p)
+	}
+}
+
+// NewConsole loads an iNES ROM. It returns an error if
+// the file is malformed or uses an unsupported mapper.
+func NewConsole(r io.Reader, options ...Option) (*Console, error) {
 	c := &Console{}
 	err := c.loadROM(r)
-	return c, err
+	if err != nil {
+		return nil, err
+	}
+	for _, option := range options {
+		option(c)
+	}
+	return c, nil
+}
+
+// SetPalette changes the palette used to render
+// the following frames. A nil p restores the default.
+func (c *Console) SetPalette(p *Palette) {
+	if p == nil {
+		p = DefaultPalette()
+	}
+	c.ppu.palette = p
 }
 
 func (c *Console) loadROM(r io.Reader) error {
-	cart, err := readFile(r)
+	hash := crc32.NewIEEE()
+	cart, info, err := readFile(io.TeeReader(r, hash))
 	if err != nil {
 		return err
 	}
+	c.checksum = hash.Sum32()
+	c.cart = cart
+	c.info = info
+	if info.Battery && len(cart.prgRAM()) > 0 {
+		c.battery = cart.prgRAM()
+	}
 	c.ppu = newPPU(cart)
-	c.joypad1 = &joypad{}
-	c.cpu = newCPU(cart, c.ppu, c.joypad1)
+	c.cpu = newCPU(cart, c.ppu)
+	c.cpu.tick = c.tick
+	c.image = image.NewRGBA(image.Rect(0, 0, 256, 240))
+	for i := range c.joypads {
+		c.joypads[i] = &joypad{}
+	}
+	c.multitap = &multitap{joypads: &c.joypads}
+	c.SetMultitap(MultitapNone)
+	c.apu = c.cpu.apu
+	c.setRegion(info.Region)
+	// the rest of the console runs during the reset sequence
+	c.cpu.reset()
+	c.cpu.catchUp(c.cpu.cycles)
 	return nil
 }
 
+func (c *Console) setRegion(region Region) {
+	if region == RegionMulti {
+		region = RegionNTSC
+	}
+	c.region = region
+	c.timing = region.timing()
+	c.ppu.timing = c.timing
+	c.apu.setTiming(c.timing)
+}
+
+// Region is the timing the console runs with, either
+// from the ROM's header or as given by WithRegion
+func (c *Console) Region() Region {
+	return c.region
+}
+
+// FrameRate is the number of frames per second the
+// console renders in its region
+func (c *Console) FrameRate() float64 {
+	return c.timing.frameRate
+}
+
+// an NTSC frame is 29780.5 CPU cycles, PAL and Dendy frames
+// are a little longer. If vblank hasn't started after two
+// NTSC frames worth RenderFrame returns anyway so a broken
+// game can't hang the caller.
+const maxFrameCycles = 2 * 29781
+
+// RenderFrame runs the console until the PPU reaches the
+// start of vblank, which is when the next frame has been
+// drawn to image. This doesn't depend on the game enabling
+// NMI. It returns early if the console halts.
 func (c *Console) RenderFrame(image *image.RGBA) {
-	for {
-		cycles := c.cpu.Step()
-		cycles *= 3
-		beforeNMI := c.ppu.nmiTriggered()
-		for ; cycles > 0; cycles-- {
-			c.ppu.step(image)
-		}
-		afterNMI := c.ppu.nmiTriggered()
-		if !beforeNMI && afterNMI {
-			c.cpu.triggerNMI()
+	c.apu.samples = c.apu.samples[:0]
+	frame := c.ppu.frame
+	c.image = image
+	for cycles := 0; cycles < maxFrameCycles && c.ppu.frame == frame; {
+		stepped := c.cpu.Step()
+		if c.checkFault() {
 			break
 		}
+		// a step that takes no time still counts
+		// towards the limit
+		if stepped == 0 {
+			stepped = 1
+		}
+		cycles += stepped
+	}
+}
+
+// tick runs the APU for one CPU cycle and the PPU for
+// three, or 3.2 on PAL. The cpu calls it as it runs
+// each instruction.
+func (c *Console) tick() {
+	c.apu.step()
+	for c.dots += c.timing.dotsPer5Cycles; c.dots >= 5; c.dots -= 5 {
+		c.ppu.step(c.image)
+	}
+}
+
+// checkFault halts the console if any of its
+// components made an illegal access.
+func (c *Console) checkFault() bool {
+	switch {
+	case c.cpu.err != nil:
+		c.err = c.cpu.err
+	case c.cart.fault() != nil:
+		c.err = c.cart.fault()
+	}
+	return c.err != nil
+}
+
+// Halted reports whether the console has stopped
+// running because of a fault. See Err.
+func (c *Console) Halted() bool {
+	return c.err != nil
+}
+
+// Err returns the fault that halted the console such as
+// a JAM opcode or an illegal memory access, or nil if the
+// console is still running.
+func (c *Console) Err() error {
+	return c.err
+}
+
+// CartridgeInfo describes the loaded ROM
+func (c *Console) CartridgeInfo() CartridgeInfo {
+	return *c.info
+}
+
+// HasBattery reports whether the cartridge has battery backed
+// PRG RAM that should be persisted between sessions.
+func (c *Console) HasBattery() bool {
+	return c.battery != nil
+}
+
+// SaveBattery writes the battery backed PRG RAM as a raw
+// dump, the same layout as a .sav file.
+func (c *Console) SaveBattery(w io.Writer) error {
+	if c.battery == nil {
+		return errors.New("cartridge has no battery")
+	}
+	_, err := w.Write(c.battery)
+	return errors.Wrap(err, "save battery")
+}
+
+// LoadBattery seeds the battery backed PRG RAM from a .sav file.
+func (c *Console) LoadBattery(r io.Reader) error {
+	if c.battery == nil {
+		return errors.New("cartridge has no battery")
+	}
+	ram := make([]byte, len(c.battery))
+	_, err := io.ReadFull(r, ram)
+	if err != nil {
+		return errors.Wrap(err, "load battery")
+	}
+	copy(c.battery, ram)
+	return nil
+}
+
+// AudioSamples returns the mono audio samples produced
+// during the last call to RenderFrame at SampleRate.
+// The returned slice is reused by the next frame.
+func (c *Console) AudioSamples() []float32 {
+	return c.apu.samples
+}
+
+// SetInputDevice plugs device into port, Port1 or Port2,
+// replacing whatever was there. A nil device unplugs the port.
+// By default both ports have a standard joypad, which
+// SetMultitap(MultitapNone) puts back. Other ports are ignored.
+func (c *Console) SetInputDevice(port int, device InputDevice) {
+	if port < 0 || port >= len(c.cpu.ports) {
+		return
+	}
+	c.cpu.ports[port] = device
+}
+
+// SetMultitap connects the joypads to the controller ports
+// through the multitap, replacing any devices plugged in.
+// MultitapNone puts joypads 1 and 2 back in their ports.
+func (c *Console) SetMultitap(m Multitap) {
+	c.multitap.kind = m
+	for i := range c.cpu.ports {
+		if m == MultitapNone {
+			c.cpu.ports[i] = c.joypads[i]
+		} else {
+			c.cpu.ports[i] = &multitapPort{tap: c.multitap, port: i}
+		}
+	}
+}
+
+// SetJoypad presses or releases button on player's joypad.
+// Player1 uses the joypad in port 1 and Player2 port 2.
+// Player3 and Player4 are only read through a multitap.
+// Other players are ignored.
+func (c *Console) SetJoypad(player int, button byte, pressed bool) {
+	if player < 0 || player >= len(c.joypads) {
+		return
+	}
+	c.joypads[player].setButton(button, pressed)
+}
+
+// SaveState writes a snapshot of the entire console
+// that can later be restored with LoadState.
+func (c *Console) SaveState(w io.Writer) error {
+	s := &stateStream{w: w}
+	s.sync(uint32(stateMagic), uint16(stateVersion), c.checksum)
+	c.syncState(s)
+	return errors.Wrap(s.err, "save state")
+}
+
+// LoadState restores a snapshot written by SaveState. The
+// snapshot must have been taken while running the same ROM.
+// If the snapshot can't be loaded the console is unchanged,
+// otherwise a halted console runs again.
+func (c *Console) LoadState(r io.Reader) error {
+	var magic, checksum uint32
+	var version uint16
+	s := &stateStream{r: r}
+	s.sync(&magic, &version, &checksum)
+	switch {
+	case s.err != nil:
+		return errors.Wrap(s.err, "load state")
+	case magic != stateMagic:
+		return errors.New("invalid save state")
+	case version != stateVersion:
+		return errors.Errorf("unsupported save state version %d", version)
+	case checksum != c.checksum:
+		return errors.New("save state is for a different ROM")
 	}
+
+	// keep a copy of the current state in case
+	// the snapshot is truncated
+	var backup bytes.Buffer
+	c.syncState(&stateStream{w: &backup})
+	c.syncState(s)
+	if s.err != nil {
+		c.syncState(&stateStream{r: &backup})
+		return errors.Wrap(s.err, "load state")
+	}
+	// the console runs again from the snapshot
+	// even if it had halted since
+	c.err = nil
+	c.cpu.err = nil
+	c.cart.clearFault()
+	return nil
 }
 
-func (c *Console) SetJoypad(button byte, pressed bool) {
-	if pressed {
-		c.joypad1.buttonState = setBits(c.joypad1.buttonState, button)
-	} else {
-		c.joypad1.buttonState = resetBits(c.joypad1.buttonState, button)
+func (c *Console) syncState(s *stateStream) {
+	c.cpu.syncState(s)
+	c.ppu.syncState(s)
+	c.apu.syncState(s)
+	c.cart.syncState(s)
+	for _, j := range c.joypads {
+		j.syncState(s)
 	}
+	c.multitap.syncState(s)
+	s.sync(&c.dots)
 }
@@ -0,0 +1,319 @@
+package nes
+
+import (
+	"bytes"
+	"hash/crc32"
+	"image"
+	"testing"
+)
+
+// testROM builds an iNES file with a single 16k PRG bank
+// filled with program and the reset vector at $8000
+func testROM(mapper byte, program ...byte) []byte {
+	header := []byte{'N', 'E', 'S', 0x1A, 1, 1, mapper << 4, mapper & 0xF0, 0, 0, 0, 0, 0, 0, 0, 0}
+	prg := make([]byte, 0x4000)
+	copy(prg, program)
+	prg[0x3FFC] = 0x00
+	prg[0x3FFD] = 0x80
+	chr := make([]byte, 0x2000)
+	return append(append(header, prg...), chr...)
+}
+
+func TestUnsupportedMapper(t *testing.T) {
+	_, err := NewConsole(bytes.NewReader(testROM(255)))
+	if err == nil {
+		t.Fatal("expected an error for mapper 255")
+	}
+}
+
+func TestHalt(t *testing.T) {
+	// NOP then a JAM opcode
+	c, err := NewConsole(bytes.NewReader(testROM(0, 0xEA, 0x02)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RenderFrame(image.NewRGBA(image.Rect(0, 0, 256, 240)))
+	if !c.Halted() || c.Err() == nil {
+		t.Fatal("expected the console to halt")
+	}
+	if c.cpu.pc != 0x8001 {
+		t.Fatalf("pc = %04X, want 8001", c.cpu.pc)
+	}
+}
+
+func TestROMWrites(t *testing.T) {
+	// LDA #$12, STA $8000, STA $6000 then a JAM opcode
+	for mapper := byte(0); mapper < 4; mapper++ {
+		c, err := NewConsole(bytes.NewReader(testROM(mapper, 0xA9, 0x12, 0x8D, 0x00, 0x80, 0x8D, 0x00, 0x60, 0x02)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.RenderFrame(image.NewRGBA(image.Rect(0, 0, 256, 240)))
+		if c.cpu.pc != 0x8008 {
+			t.Fatalf("mapper %d: halted at %04X: %v", mapper, c.cpu.pc, c.Err())
+		}
+		c.ppu.write(0x0000, 0x34)
+		if value := c.ppu.readByte(0x0000); value != 0 {
+			t.Fatalf("mapper %d: CHR ROM = %02X, want 00", mapper, value)
+		}
+	}
+
+	// no CHR ROM means 8k of CHR RAM
+	rom := testROM(0)
+	rom[5] = 0
+	c, err := NewConsole(bytes.NewReader(rom[:16+0x4000]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ppu.write(0x1FFF, 0x34)
+	if value := c.ppu.readByte(0x1FFF); value != 0x34 {
+		t.Fatalf("CHR RAM = %02X, want 34", value)
+	}
+}
+
+func TestBattery(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.HasBattery() {
+		t.Fatal("expected no battery")
+	}
+
+	rom := testROM(1)
+	rom[6] |= flag6Battery
+	c, err = NewConsole(bytes.NewReader(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasBattery() {
+		t.Fatal("expected a battery")
+	}
+
+	sav := make([]byte, 0x2000)
+	sav[0x123] = 0x45
+	if err := c.LoadBattery(bytes.NewReader(sav)); err != nil {
+		t.Fatal(err)
+	}
+	if value := c.cpu.readByte(0x6123); value != 0x45 {
+		t.Fatalf("$6123 = %02X, want 45", value)
+	}
+	c.cpu.writeByte(0x7FFF, 0x67)
+	var buf bytes.Buffer
+	if err := c.SaveBattery(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0x2000 || buf.Bytes()[0x1FFF] != 0x67 {
+		t.Fatal("battery RAM not saved")
+	}
+}
+
+func TestTrainer(t *testing.T) {
+	rom := testROM(0)
+	rom[6] |= flag6Trainer | flag6FourScreen
+	trainer := make([]byte, trainerSize)
+	trainer[0] = 0x12
+	trainer[trainerSize-1] = 0x34
+	rom = append(append(append([]byte(nil), rom[:16]...), trainer...), rom[16:]...)
+
+	c, err := NewConsole(bytes.NewReader(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.cpu.readByte(0x7000) != 0x12 || c.cpu.readByte(0x71FF) != 0x34 {
+		t.Fatal("trainer not loaded at $7000")
+	}
+	// PRG is not offset by the trainer
+	if c.cpu.pc != 0x8000 {
+		t.Fatalf("pc = %04X, want 8000", c.cpu.pc)
+	}
+	if c.CartridgeInfo().Mirroring != MirrorFourScreen {
+		t.Fatal("expected four screen mirroring")
+	}
+	// each nametable is unique
+	for i := uint16(0); i < 4; i++ {
+		c.ppu.write(0x2000+i*0x400, byte(i+1))
+	}
+	for i := uint16(0); i < 4; i++ {
+		if value := c.ppu.readByte(0x2000 + i*0x400); value != byte(i+1) {
+			t.Fatalf("nametable %d = %d, want %d", i, value, i+1)
+		}
+	}
+}
+
+func TestSecondController(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetJoypad(Player2, ButtonB, true)
+	c.cpu.writeByte(0x4016, 1)
+	c.cpu.writeByte(0x4016, 0)
+	// LDA $4017 leaves the high byte of the address on the bus
+	c.cpu.bus = 0x40
+	want := []byte{0x40, 0x41, 0x40}
+	for i, w := range want {
+		if value := c.cpu.readByte(0x4017); value != w {
+			t.Fatalf("read %d of $4017 = %02X, want %02X", i, value, w)
+		}
+	}
+	if value := c.cpu.readByte(0x4016); value != 0x40 {
+		t.Fatalf("$4016 = %02X, want 40", value)
+	}
+
+	c.SetInputDevice(Port2, nil)
+	if value := c.cpu.readByte(0x4017); value != 0x40 {
+		t.Fatalf("unplugged $4017 = %02X, want 40", value)
+	}
+
+	// there are only two ports
+	c.SetInputDevice(2, nil)
+	c.SetInputDevice(-1, nil)
+}
+
+func TestMultitap(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetJoypad(Player1, ButtonA, true)
+	c.SetJoypad(Player3, ButtonB, true)
+	c.SetJoypad(Player4, ButtonStart, true)
+
+	read := func(address uint16, shift byte) uint32 {
+		var bits uint32
+		for i := 0; i < 24; i++ {
+			bits |= uint32(c.cpu.readByte(address)>>shift&1) << i
+		}
+		return bits
+	}
+
+	c.SetMultitap(MultitapFourScore)
+	c.cpu.writeByte(0x4016, 1)
+	c.cpu.writeByte(0x4016, 0)
+	if bits := read(0x4016, 0); bits != 0x080201 {
+		t.Fatalf("Four Score port 1 = %06X, want 080201", bits)
+	}
+	if bits := read(0x4017, 0); bits != 0x040800 {
+		t.Fatalf("Four Score port 2 = %06X, want 040800", bits)
+	}
+
+	c.SetMultitap(MultitapHori)
+	c.cpu.writeByte(0x4016, 1)
+	c.cpu.writeByte(0x4016, 0)
+	if bits := read(0x4016, 1); bits != 0x040002 {
+		t.Fatalf("Hori $4016 D1 = %06X, want 040002", bits)
+	}
+	if bits := read(0x4017, 1); bits != 0x080008 {
+		t.Fatalf("Hori $4017 D1 = %06X, want 080008", bits)
+	}
+
+	// there are only four players
+	c.SetJoypad(4, ButtonA, true)
+	c.SetJoypad(-1, ButtonA, true)
+}
+
+func TestFrameWithoutNMI(t *testing.T) {
+	// JMP $8000 without ever enabling NMI
+	c, err := NewConsole(bytes.NewReader(testROM(0, 0x4C, 0x00, 0x80)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	for i := 1; i <= 3; i++ {
+		c.RenderFrame(img)
+		if c.ppu.frame != uint64(i) || c.ppu.scanline != 241 {
+			t.Fatalf("frame %d ended at frame %d scanline %d", i, c.ppu.frame, c.ppu.scanline)
+		}
+	}
+}
+
+func TestNMI(t *testing.T) {
+	// enable NMI and loop, the handler at $8010 counts frames
+	rom := testROM(0, 0xA9, 0x80, 0x8D, 0x00, 0x20, 0x4C, 0x05, 0x80)
+	copy(rom[16+0x10:], []byte{0xE6, 0x00, 0x40})
+	rom[16+0x3FFA] = 0x10
+	rom[16+0x3FFB] = 0x80
+	c, err := NewConsole(bytes.NewReader(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	for i := 0; i < 3; i++ {
+		c.RenderFrame(img)
+	}
+	// the NMI for the last frame is serviced in the next one
+	if c.cpu.ram[0] != 2 {
+		t.Fatalf("%d NMIs, want 2", c.cpu.ram[0])
+	}
+}
+
+func TestRegion(t *testing.T) {
+	rom := testROM(0, 0x4C, 0x00, 0x80)
+	// iNES 1.0 flags PAL in Flags9
+	rom[9] = 1
+	img := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	tests := []struct {
+		options  []Option
+		region   Region
+		scanline int
+		// CPU cycles over 10 frames
+		cycles uint64
+	}{
+		{nil, RegionPAL, 241, 332475},
+		{[]Option{WithRegion(RegionNTSC)}, RegionNTSC, 241, 297805},
+		{[]Option{WithRegion(RegionDendy)}, RegionDendy, 291, 354640},
+	}
+	for _, test := range tests {
+		c, err := NewConsole(bytes.NewReader(rom), test.options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Region() != test.region {
+			t.Fatalf("region = %v, want %v", c.Region(), test.region)
+		}
+		c.RenderFrame(img)
+		start := c.cpu.cycles
+		for i := 0; i < 10; i++ {
+			c.RenderFrame(img)
+		}
+		if c.ppu.scanline != test.scanline {
+			t.Fatalf("%v vblank on scanline %d, want %d", test.region, c.ppu.scanline, test.scanline)
+		}
+		cycles := c.cpu.cycles - start
+		if cycles < test.cycles-5 || cycles > test.cycles+5 {
+			t.Fatalf("%v 10 frames took %d cycles, want %d", test.region, cycles, test.cycles)
+		}
+	}
+}
+
+func TestRegionDatabase(t *testing.T) {
+	rom := testROM(0)
+	db := map[uint32]Region{crc32.ChecksumIEEE(rom[16:]): RegionPAL}
+	c, err := NewConsole(bytes.NewReader(rom), WithRegionDatabase(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region() != RegionPAL {
+		t.Fatalf("region = %v, want PAL", c.Region())
+	}
+
+	// a forced region wins whatever the order
+	c, err = NewConsole(bytes.NewReader(rom), WithRegion(RegionDendy), WithRegionDatabase(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region() != RegionDendy {
+		t.Fatalf("forced region = %v, want Dendy", c.Region())
+	}
+
+	// NES 2.0 headers give the region
+	rom[7] |= 0x08
+	c, err = NewConsole(bytes.NewReader(rom), WithRegionDatabase(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Region() != RegionNTSC {
+		t.Fatalf("NES 2.0 region = %v, want NTSC", c.Region())
+	}
+}
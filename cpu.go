@@ -1,7 +1,7 @@
 package nes
 
 import (
-	"log"
+	"github.com/pkg/errors"
 )
 
 const (
@@ -31,6 +31,36 @@ const (
 	modeZeroPageY
 )
 
+// Devices that can hold the IRQ line low. The line stays
+// asserted until every source has released it.
+const (
+	irqFrameCounter byte = 1 << iota
+	irqDMC
+	irqMapper
+)
+
+// Sources of the interrupt sequence
+const (
+	interruptBRK = iota
+	interruptIRQ
+	interruptNMI
+	interruptReset
+)
+
+// When the current instruction polls for interrupts
+const (
+	// before its last cycle
+	pollLastCycle = iota
+	// before its last cycle but with the I flag from before
+	// the instruction. CLI, SEI and PLP change it after the
+	// poll so the change only shows at the next one.
+	pollOldMask
+	// already polled by a taken branch that stays in its
+	// page, or the interrupt sequence, which doesn't poll
+	// so the first instruction of the handler always runs
+	pollNone
+)
+
 type cpu struct {
 	cycles uint64 // total cycle counter
 	pc     uint16 // 16 bit program counter
@@ -46,68 +76,290 @@ type cpu struct {
 
 	cart cartridge
 	ppu  *ppu
+	apu  *apu
+	// nil unless the cartridge has hardware at $4020-$5FFF
+	expansion expansionCartridge
 
-	nmiTriggered bool
-
-	// joypads
-	joypad1 *joypad
-}
+	// the last value read or written on the data bus. Reads
+	// that nothing responds to, or only some bits of, see it.
+	bus byte
 
-func newCPU(cart cartridge, ppu *ppu, j1 *joypad) *cpu {
+	// set when the NMI edge from the PPU is seen
+	// and serviced before the next instruction
+	nmiTriggered bool
+	// set when IRQ was asserted and unmasked at the
+	// last poll and serviced before the next instruction
+	irqTriggered bool
+	// when the current instruction polls for interrupts
+	poll int
+
+	// one bit per source currently asserting IRQ
+	irqLine byte
+	// the NMI edge and IRQ line as the last bus access
+	// started. A poll sees these, so what that access
+	// does to them waits for the next poll.
+	sampledNMI bool
+	sampledIRQ byte
+
+	// OAM DMA requested by a write to $4014. It copies
+	// oamDMAPage to OAM once the cpu next reads.
+	oamDMA     bool
+	oamDMAPage byte
+	// DMC DMA requested by the APU to fill its sample
+	// buffer. dmcDelay counts down the halt and dummy
+	// cycles it waits before it can read.
+	dmcDMA   bool
+	dmcDelay int
+
+	// controller ports, nil when nothing is plugged in
+	ports [2]InputDevice
+
+	// tick runs the rest of the console for one CPU cycle.
+	// The cpu calls it to keep the PPU and APU in step with
+	// its memory accesses. nil when the cpu runs alone.
+	tick func()
+	// cycles that tick has been called for
+	ticked uint64
+
+	// once set the cpu is halted
+	err error
+}
+
+func newCPU(cart cartridge, ppu *ppu) *cpu {
 	cpu := &cpu{
-		cart:    cart,
-		ppu:     ppu,
-		joypad1: j1,
+		cart: cart,
+		ppu:  ppu,
+		// bit 5 always reads as set
+		status: cpuFlagU,
+	}
+	cpu.apu = newAPU(cpu)
+	if cpuCart, ok := cart.(cpuCartridge); ok {
+		cpuCart.connectCPU(cpu)
 	}
-	cpu.reset()
+	cpu.expansion, _ = cart.(expansionCartridge)
 	return cpu
 }
 
-func (c *cpu) reset() {
-	// Program counter always starts at 0xFFFC
-	c.pc = c.readWord(0xFFFC)
-	c.sp = 0xFD
-	c.status = 0x24
+func (c *cpu) syncState(s *stateStream) {
+	s.sync(&c.cycles, &c.pc, &c.sp, &c.a, &c.x, &c.y, &c.status, &c.ram)
+	s.sync(&c.nmiTriggered, &c.irqTriggered, &c.irqLine)
+	s.sync(&c.oamDMA, &c.oamDMAPage, &c.dmcDMA, &c.dmcDelay, &c.bus)
+	c.ticked = c.cycles
 }
 
-func (c *cpu) nmi() int {
-	c.pushWord(c.pc)
-	c.php(0)
-	c.pc = c.readWord(0xFFFA)
+// reset runs the reset sequence. At power on the stack
+// pointer starts at 0 so it ends up at FD.
+func (c *cpu) reset() {
+	c.interrupt(interruptReset)
+}
+
+// interrupt runs the 7 cycle sequence shared by BRK, IRQ,
+// NMI and reset, after its cycles have been counted. It
+// pushes pc and the status, with B set only for BRK, and
+// jumps through the vector. Reset turns the pushes into
+// reads so only the stack pointer changes.
+func (c *cpu) interrupt(source int) {
+	if source != interruptBRK {
+		// BRK fetches its opcode and padding byte,
+		// the others read pc twice and ignore it
+		c.read(c.pc)
+		c.read(c.pc)
+	}
+	if source == interruptReset {
+		for i := 0; i < 3; i++ {
+			c.read(0x100 | uint16(c.sp))
+			c.sp--
+		}
+	} else {
+		c.pushWord(c.pc)
+		status := c.status | cpuFlagU
+		if source == interruptBRK {
+			status = setBits(status, cpuFlagB)
+		} else {
+			status = resetBits(status, cpuFlagB)
+		}
+		c.push(status)
+	}
+	vector := uint16(0xFFFE)
+	switch source {
+	case interruptNMI:
+		vector = 0xFFFA
+	case interruptReset:
+		vector = 0xFFFC
+	default:
+		// an NMI during the first 4 cycles of BRK or IRQ
+		// hijacks the sequence, which then uses its vector
+		if c.ppu.nmiEdge {
+			c.ppu.nmiEdge = false
+			vector = 0xFFFA
+		}
+	}
 	c.status = setBits(c.status, cpuFlagI)
+	c.pc = c.readWord(vector)
 	c.nmiTriggered = false
-	return 7
+	c.irqTriggered = false
+	c.poll = pollNone
+}
+
+// catchUp ticks the rest of the console up to cycle
+func (c *cpu) catchUp(cycle uint64) {
+	for c.ticked < cycle {
+		c.ticked++
+		if c.tick != nil {
+			c.tick()
+		}
+	}
+}
+
+// assertIRQ pulls the IRQ line low on behalf of source
+func (c *cpu) assertIRQ(source byte) {
+	c.irqLine = setBits(c.irqLine, source)
 }
 
-func (c *cpu) triggerNMI() {
-	c.nmiTriggered = true
+// releaseIRQ stops source from holding the IRQ line
+func (c *cpu) releaseIRQ(source byte) {
+	c.irqLine = resetBits(c.irqLine, source)
 }
 
-// readByte reads a byte from the memory map
+// readByte reads a byte from the memory map. Addresses
+// nothing responds to return the last value on the bus.
 func (c *cpu) readByte(address uint16) byte {
 	switch {
 	case address < 0x2000:
-		return c.ram[address%0x800]
+		c.bus = c.ram[address%0x800]
 	case address < 0x4000:
-		return c.ppu.readRegister((address - 0x4000) % 8)
-	case address == 0x4016:
-		// joypad 1
-		return c.joypad1.read()
+		// the 8 PPU registers are mirrored every 8 bytes
+		c.bus = c.ppu.readRegister(address % 8)
+	case address == 0x4015:
+		// the status is read inside the 2A03 so the bus
+		// keeps its value, which shows in bit 5
+		return c.apu.readStatus() | c.bus&0x20
+	case address == 0x4016, address == 0x4017:
+		c.bus = c.readPort(address - 0x4016)
 	case address < 0x4020:
-		// todo APU
-	case address >= 0x6000:
-		return c.cart.readByte(address)
+		// the rest of the APU and I/O registers are write only
+	case address < 0x6000:
+		if c.expansion != nil {
+			c.bus = c.expansion.readExpansion(address)
+		}
 	default:
-		log.Fatalf("invalid read address %02X", address)
+		if c.cart.mapped(address) {
+			c.bus = c.cart.readByte(address)
+		}
+	}
+	return c.bus
+}
+
+// peek reads RAM or the cartridge without touching
+// the bus. Registers, whose reads have side effects,
+// give the last value on the bus.
+func (c *cpu) peek(address uint16) byte {
+	switch {
+	case address < 0x2000:
+		return c.ram[address%0x800]
+	case address >= 0x6000 && c.cart.mapped(address):
+		return c.cart.readByte(address)
+	}
+	return c.bus
+}
+
+func (c *cpu) readPort(port uint16) byte {
+	device := c.ports[port]
+	if device == nil {
+		return c.bus
+	}
+	return c.bus&^portMask | device.Read()&portMask
+}
+
+// read is a bus read, which takes a cycle. The rest of
+// the console has run up to that cycle when it happens.
+// Pending DMA halts the cpu before the read.
+func (c *cpu) read(address uint16) byte {
+	c.catchUp(c.cycles)
+	if c.oamDMA || c.dmcDMA {
+		c.runDMA(address)
+	}
+	c.sampleInterrupts()
+	c.cycles++
+	return c.readByte(address)
+}
+
+// sampleInterrupts records the interrupt lines before
+// a bus access for the poll that follows it
+func (c *cpu) sampleInterrupts() {
+	c.sampledNMI = c.ppu.nmiEdge
+	c.sampledIRQ = c.irqLine
+}
+
+// requestDMC asks for a DMC DMA, which starts at the
+// next read. It waits for a halt and a dummy cycle.
+func (c *cpu) requestDMC() {
+	if !c.dmcDMA {
+		c.dmcDMA = true
+		c.dmcDelay = 2
+	}
+}
+
+// runDMA runs the pending DMA transfers while the cpu is
+// halted trying to read address. The PPU and APU keep
+// running. DMA reads on get cycles and OAM DMA writes on
+// the put cycles in between, so it may first wait a cycle
+// to align. A DMC read takes the place of an OAM read.
+func (c *cpu) runDMA(address uint16) {
+	// the halted read still happens and is repeated on
+	// each cycle the cpu waits. The controllers only see
+	// the first of several reads on consecutive cycles.
+	repeat := address != 0x4016 && address != 0x4017
+	c.dmaCycle()
+	c.readByte(address)
+	var value byte
+	read := false
+	index := uint16(0)
+	for c.oamDMA || c.dmcDMA {
+		c.catchUp(c.cycles)
+		get := !c.apu.odd
+		dmcReady := c.dmcDMA && c.dmcDelay == 0
+		c.dmaCycle()
+		switch {
+		case get && dmcReady:
+			c.dmcDMA = false
+			c.apu.dmc.loadBuffer(c.readByte(c.apu.dmc.currentAddress))
+		case get && c.oamDMA && !read:
+			value = c.readByte(uint16(c.oamDMAPage)<<8 | index)
+			read = true
+		case !get && read:
+			c.ppu.writeDMA(value)
+			read = false
+			index++
+			c.oamDMA = index < 256
+		case repeat:
+			c.readByte(address)
+		}
+	}
+}
+
+// dmaCycle is a cycle the cpu spends halted for DMA
+func (c *cpu) dmaCycle() {
+	c.catchUp(c.cycles)
+	c.cycles++
+	if c.dmcDelay > 0 {
+		c.dmcDelay--
 	}
-	return 0
 }
 
-// readWord reads a 16 bit word from the memory map
+// write is a bus write, which takes a cycle
+func (c *cpu) write(address uint16, value byte) {
+	c.catchUp(c.cycles)
+	c.sampleInterrupts()
+	c.cycles++
+	c.writeByte(address, value)
+}
+
+// readWord reads a 16 bit word from the bus
 // low byte first.
 func (c *cpu) readWord(address uint16) uint16 {
-	low := uint16(c.readByte(address))
-	high := uint16(c.readByte(address + 1))
+	low := uint16(c.read(address))
+	high := uint16(c.read(address + 1))
 	return (high << 8) | low
 }
 
@@ -115,1279 +367,152 @@ func (c *cpu) readWord(address uint16) uint16 {
 // if the high byte would be on another page
 // wrap aroudn to the beginning of the page
 func (c *cpu) readWordPageWrap(address uint16) uint16 {
-	low := uint16(c.readByte(address))
+	low := uint16(c.read(address))
 	highAddress := (address & 0xFF00) | uint16(byte(address+1))
-	high := uint16(c.readByte(highAddress))
+	high := uint16(c.read(highAddress))
 	return (high << 8) | low
 }
 
-func (c *cpu) write(address uint16, value byte) {
+// writeByte writes a byte to the memory map
+func (c *cpu) writeByte(address uint16, value byte) {
+	c.bus = value
 	switch {
 	case address < 0x2000:
 		c.ram[address%0x800] = value
 	case address < 0x4000:
-		c.ppu.writeRegister((address-0x4000)%8, value)
+		c.ppu.writeRegister(address%8, value)
 	case address == 0x4014:
-		// OAMDMA
-		dmaAddress := uint16(value) << 8
-		for i := uint16(0); i < 256; i++ {
-			dmaByte := c.readByte(dmaAddress + i)
-			c.ppu.writeDMA(dmaByte)
-		}
-		c.cycles += 513
-		if c.cycles%2 == 1 {
-			c.cycles++
-		}
+		c.oamDMA = true
+		c.oamDMAPage = value
 	case address == 0x4016:
-		c.joypad1.write(value)
+		// the strobe goes to both ports
+		for _, device := range c.ports {
+			if device != nil {
+				device.Write(value)
+			}
+		}
+	case address < 0x4018:
+		c.apu.writeRegister(address, value)
 	case address < 0x4020:
-		// TODO implement APU
-	case address >= 0x6000:
-		c.cart.write(address, value)
+		// APU and I/O test mode registers are disabled
+	case address < 0x6000:
+		if c.expansion != nil {
+			c.expansion.writeExpansion(address, value)
+		}
 	default:
-		log.Fatalf("invalid write address %04X", address)
+		c.cart.write(address, value)
 	}
 }
 
 // Step steps the CPU forward one instruction returning
-// the number of cyles it took.
+// the number of cyles it took. A halted cpu doesn't step.
 func (c *cpu) Step() int {
-	if c.nmiTriggered {
-		return c.nmi()
+	if c.err != nil {
+		return 0
 	}
-	opcode := c.readByte(c.pc)
-	var inst func(address uint16)
-	var mode int
-	cycles := c.cycles
-	var bytes uint16
-	var address uint16
-	noPageCrossed := false
-	switch opcode {
-	case 0x4C:
-		inst = c.jmp
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 3
-	case 0xA2:
-		inst = c.ldx
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0x86:
-		inst = c.stx
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x20:
-		inst = c.jsr
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0xEA:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x38:
-		inst = c.sec
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xB0:
-		inst = c.bcs
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0x18:
-		inst = c.clc
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x90:
-		inst = c.bcc
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0xA9:
-		inst = c.lda
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xF0:
-		inst = c.beq
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0xD0:
-		inst = c.bne
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0x85:
-		inst = c.sta
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x24:
-		inst = c.bit
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x70:
-		inst = c.bvs
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0x50:
-		inst = c.bvc
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0x10:
-		inst = c.bpl
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0x60:
-		inst = c.rts
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 6
-	case 0x78:
-		inst = c.sei
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xF8:
-		inst = c.sed
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x08:
-		inst = c.php
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 3
-	case 0x68:
-		inst = c.pla
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 4
-	case 0x29:
-		inst = c.and
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xC9:
-		inst = c.cmp
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xD8:
-		inst = c.cld
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x48:
-		inst = c.pha
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 3
-	case 0x28:
-		inst = c.plp
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 4
-	case 0x30:
-		inst = c.bmi
-		mode = modeRelative
-		bytes = 2
-		c.cycles += 2
-	case 0x09:
-		inst = c.ora
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xB8:
-		inst = c.clv
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x49:
-		inst = c.eor
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0x69:
-		inst = c.adc
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xA0:
-		inst = c.ldy
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xC0:
-		inst = c.cpy
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xE0:
-		inst = c.cpx
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xE9:
-		inst = c.sbc
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xC8:
-		inst = c.iny
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xE8:
-		inst = c.inx
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x88:
-		inst = c.dey
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xCA:
-		inst = c.dex
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xA8:
-		inst = c.tay
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xAA:
-		inst = c.tax
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x98:
-		inst = c.tya
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x8A:
-		inst = c.txa
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xBA:
-		inst = c.tsx
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x8E:
-		inst = c.stx
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x9A:
-		inst = c.txs
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xAE:
-		inst = c.ldx
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xAD:
-		inst = c.lda
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x40:
-		inst = c.rti
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 6
-	case 0x4A:
-		inst = c.lsra
-		mode = modeAccumulator
-		bytes = 1
-		c.cycles += 2
-	case 0x0A:
-		inst = c.asla
-		mode = modeAccumulator
-		bytes = 1
-		c.cycles += 2
-	case 0x6A:
-		inst = c.rora
-		mode = modeAccumulator
-		bytes = 1
-		c.cycles += 2
-	case 0x2A:
-		inst = c.rola
-		mode = modeAccumulator
-		bytes = 1
-		c.cycles += 2
-	case 0xA5:
-		inst = c.lda
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x8D:
-		inst = c.sta
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xA1:
-		inst = c.lda
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0x81:
-		inst = c.sta
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0x01:
-		inst = c.ora
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0x21:
-		inst = c.and
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0x41:
-		inst = c.eor
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0x61:
-		inst = c.adc
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0xC1:
-		inst = c.cmp
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0xE1:
-		inst = c.sbc
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-	case 0xA4:
-		inst = c.ldy
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x84:
-		inst = c.sty
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0xA6:
-		inst = c.ldx
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x05:
-		inst = c.ora
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x25:
-		inst = c.and
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x45:
-		inst = c.eor
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x65:
-		inst = c.adc
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0xC5:
-		inst = c.cmp
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0xE5:
-		inst = c.sbc
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0xE4:
-		inst = c.cpx
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x46:
-		inst = c.lsr
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-	case 0xC4:
-		inst = c.cpy
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x06:
-		inst = c.asl
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-	case 0x66:
-		inst = c.ror
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-	case 0x26:
-		inst = c.rol
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-	case 0xE6:
-		inst = c.inc
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-	case 0xC6:
-		inst = c.dec
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-	case 0xAC:
-		inst = c.ldy
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x8C:
-		inst = c.sty
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x2C:
-		inst = c.bit
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x0D:
-		inst = c.ora
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x2D:
-		inst = c.and
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x4D:
-		inst = c.eor
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x6D:
-		inst = c.adc
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xCD:
-		inst = c.cmp
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xED:
-		inst = c.sbc
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xEC:
-		inst = c.cpx
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xCC:
-		inst = c.cpy
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x4E:
-		inst = c.lsr
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0x0E:
-		inst = c.asl
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0x6E:
-		inst = c.ror
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0x2E:
-		inst = c.rol
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0xEE:
-		inst = c.inc
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0xCE:
-		inst = c.dec
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-	case 0xB1:
-		inst = c.lda
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0x11:
-		inst = c.ora
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0x31:
-		inst = c.and
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0x51:
-		inst = c.eor
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0x71:
-		inst = c.adc
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0xD1:
-		inst = c.cmp
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0xF1:
-		inst = c.sbc
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0x91:
-		inst = c.sta
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x6C:
-		inst = c.jmp
-		mode = modeIndirect
-		bytes = 3
-		c.cycles += 5
-	case 0xB9:
-		inst = c.lda
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x19:
-		inst = c.ora
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x39:
-		inst = c.and
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x59:
-		inst = c.eor
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x79:
-		inst = c.adc
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0xD9:
-		inst = c.cmp
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0xF9:
-		inst = c.sbc
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x99:
-		inst = c.sta
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 5
-		noPageCrossed = true
-	case 0xB4:
-		inst = c.ldy
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x94:
-		inst = c.sty
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x15:
-		inst = c.ora
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x35:
-		inst = c.and
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x55:
-		inst = c.eor
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x75:
-		inst = c.adc
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0xD5:
-		inst = c.cmp
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0xF5:
-		inst = c.sbc
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0xB5:
-		inst = c.lda
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x95:
-		inst = c.sta
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x56:
-		inst = c.lsr
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-	case 0x16:
-		inst = c.asl
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-	case 0x76:
-		inst = c.ror
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-	case 0x36:
-		inst = c.rol
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-	case 0xF6:
-		inst = c.inc
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-	case 0xD6:
-		inst = c.dec
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-	case 0xB6:
-		inst = c.ldx
-		mode = modeZeroPageY
-		bytes = 2
-		c.cycles += 4
-	case 0x96:
-		inst = c.stx
-		mode = modeZeroPageY
-		bytes = 2
-		c.cycles += 4
-	case 0xBC:
-		inst = c.ldy
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x1D:
-		inst = c.ora
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x3D:
-		inst = c.and
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x5D:
-		inst = c.eor
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x7D:
-		inst = c.adc
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0xDD:
-		inst = c.cmp
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0xFD:
-		inst = c.sbc
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0xBD:
-		inst = c.lda
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x9D:
-		inst = c.sta
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 5
-		noPageCrossed = true
-	case 0x5E:
-		inst = c.lsr
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x1E:
-		inst = c.asl
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x7E:
-		inst = c.ror
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x3E:
-		inst = c.rol
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0xFE:
-		inst = c.inc
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0xDE:
-		inst = c.dec
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0xBE:
-		inst = c.ldx
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x04:
-		inst = c.nop
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x44:
-		inst = c.nop
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x64:
-		inst = c.nop
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x0C:
-		inst = c.nop
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x14:
-		inst = c.nop
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x34:
-		inst = c.nop
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x54:
-		inst = c.nop
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x74:
-		inst = c.nop
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0xD4:
-		inst = c.nop
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0xF4:
-		inst = c.nop
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 4
-	case 0x1A:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x3A:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x5A:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x7A:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xDA:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0xFA:
-		inst = c.nop
-		mode = modeImplied
-		bytes = 1
-		c.cycles += 2
-	case 0x80:
-		inst = c.nop
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0x1C:
-		inst = c.nop
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x3C:
-		inst = c.nop
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x5C:
-		inst = c.nop
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0x7C:
-		inst = c.nop
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0xDC:
-		inst = c.nop
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0xFC:
-		inst = c.nop
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 4
-	case 0xA3:
-		inst = c.lax
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xA7:
-		inst = c.lax
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0xAF:
-		inst = c.lax
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0xB3:
-		inst = c.lax
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 5
-	case 0xB7:
-		inst = c.lax
-		mode = modeZeroPageY
-		bytes = 2
-		c.cycles += 4
-	case 0xBF:
-		inst = c.lax
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 4
-	case 0x83:
-		inst = c.sax
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x87:
-		inst = c.sax
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 3
-	case 0x8F:
-		inst = c.sax
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 4
-	case 0x97:
-		inst = c.sax
-		mode = modeZeroPageY
-		bytes = 2
-		c.cycles += 4
-	case 0xEB:
-		inst = c.sbc
-		mode = modeImmediate
-		bytes = 2
-		c.cycles += 2
-	case 0xC3:
-		inst = c.dcp
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0xC7:
-		inst = c.dcp
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-		noPageCrossed = true
-	case 0xCF:
-		inst = c.dcp
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xD3:
-		inst = c.dcp
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0xD7:
-		inst = c.dcp
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xDB:
-		inst = c.dcp
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xDF:
-		inst = c.dcp
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0xE3:
-		inst = c.isc
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0xE7:
-		inst = c.isc
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-		noPageCrossed = true
-	case 0xEF:
-		inst = c.isc
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xF3:
-		inst = c.isc
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0xF7:
-		inst = c.isc
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xFB:
-		inst = c.isc
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0xFF:
-		inst = c.isc
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x03:
-		inst = c.slo
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x07:
-		inst = c.slo
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-		noPageCrossed = true
-	case 0x0F:
-		inst = c.slo
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x13:
-		inst = c.slo
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x17:
-		inst = c.slo
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x1B:
-		inst = c.slo
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x1F:
-		inst = c.slo
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x23:
-		inst = c.rla
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x27:
-		inst = c.rla
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-		noPageCrossed = true
-	case 0x2F:
-		inst = c.rla
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x33:
-		inst = c.rla
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x37:
-		inst = c.rla
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x3B:
-		inst = c.rla
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x3F:
-		inst = c.rla
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x43:
-		inst = c.sre
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x47:
-		inst = c.sre
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-		noPageCrossed = true
-	case 0x4F:
-		inst = c.sre
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x53:
-		inst = c.sre
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x57:
-		inst = c.sre
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x5B:
-		inst = c.sre
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x5F:
-		inst = c.sre
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 7
-		noPageCrossed = true
-	case 0x63:
-		inst = c.rra
-		mode = modeIndexedIndirect
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x67:
-		inst = c.rra
-		mode = modeZeroPage
-		bytes = 2
-		c.cycles += 5
-		noPageCrossed = true
-	case 0x6F:
-		inst = c.rra
-		mode = modeAbsolute
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x73:
-		inst = c.rra
-		mode = modeIndirectIndexed
-		bytes = 2
-		c.cycles += 8
-		noPageCrossed = true
-	case 0x77:
-		inst = c.rra
-		mode = modeZeroPageX
-		bytes = 2
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x7B:
-		inst = c.rra
-		mode = modeAbsoluteY
-		bytes = 3
-		c.cycles += 6
-		noPageCrossed = true
-	case 0x7F:
-		inst = c.rra
-		mode = modeAbsoluteX
-		bytes = 3
-		c.cycles += 6
+	start := c.cycles
+	status := c.status
+	c.poll = pollLastCycle
+	switch {
+	case c.nmiTriggered:
+		c.interrupt(interruptNMI)
+	case c.irqTriggered:
+		c.interrupt(interruptIRQ)
 	default:
-		log.Fatalf("unknown opcode %02X", opcode)
+		c.execute()
 	}
-	switch mode {
-	case modeAbsolute:
-		address = c.readWord(c.pc + 1)
+	// interrupts are polled before the last cycle
+	c.catchUp(c.cycles - 1)
+	switch c.poll {
+	case pollLastCycle:
+		c.pollInterrupts(c.status)
+	case pollOldMask:
+		c.pollInterrupts(status)
+	}
+	c.catchUp(c.cycles)
+	return int(c.cycles - start)
+}
+
+// pollInterrupts latches an NMI edge from the PPU or
+// IRQ if the line is low and status doesn't mask it, as
+// they were before the last bus access. Interrupts seen
+// later wait for the next instruction. An edge that a
+// $2002 read suppressed since is lost.
+func (c *cpu) pollInterrupts(status byte) {
+	if c.sampledNMI && c.ppu.nmiEdge {
+		c.ppu.nmiEdge = false
+		c.nmiTriggered = true
+	}
+	c.irqTriggered = c.sampledIRQ != 0 && !isAnySet(status, cpuFlagI)
+}
+
+// execute runs the instruction at pc making the same
+// bus accesses as the real cpu, one per cycle, including
+// the dummy reads and writes
+func (c *cpu) execute() {
+	inst := &instructions[c.read(c.pc)]
+	c.pc++
+	var address uint16
+	switch inst.mode {
+	case modeImplied, modeAccumulator:
+		// the byte after the opcode is read and ignored
+		c.read(c.pc)
 	case modeImmediate:
-		address = c.pc + 1
+		address = c.pc
+		c.pc++
+	case modeAbsolute:
+		address = c.readWord(c.pc)
+		c.pc += 2
 	case modeZeroPage:
-		address = uint16(c.readByte(c.pc + 1))
+		address = uint16(c.read(c.pc))
+		c.pc++
 	case modeRelative:
 		// address is a relative offset signed byte
-		offset := uint16(c.readByte(c.pc + 1))
-		if offset < 0x80 {
-			address = c.pc + 2 + offset
-		} else {
-			address = c.pc + 2 + offset - 0x100
-		}
+		offset := c.read(c.pc)
+		c.pc++
+		address = c.pc + uint16(int8(offset))
 	case modeIndexedIndirect:
-		address = c.readWordPageWrap(uint16(c.readByte(c.pc+1) + c.x))
+		pointer := c.read(c.pc)
+		c.pc++
+		// the pointer is read while X is added to it
+		c.read(uint16(pointer))
+		address = c.readWordPageWrap(uint16(pointer + c.x))
 	case modeIndirectIndexed:
-		offset := c.readWordPageWrap(uint16(c.readByte(c.pc + 1)))
-		address = offset + uint16(c.y)
-		if pageCrossed(offset, address) && !noPageCrossed {
-			c.cycles++
-		}
+		pointer := c.read(c.pc)
+		c.pc++
+		address = c.index(c.readWordPageWrap(uint16(pointer)), c.y, inst.pagePenalty)
 	case modeIndirect:
-		address = c.readWordPageWrap(c.readWord(c.pc + 1))
+		address = c.readWordPageWrap(c.readWord(c.pc))
+		c.pc += 2
 	case modeAbsoluteY:
-		offset := c.readWord(c.pc + 1)
-		address = offset + uint16(c.y)
-		if pageCrossed(offset, address) {
-			c.cycles++
-		}
+		address = c.index(c.readWord(c.pc), c.y, inst.pagePenalty)
+		c.pc += 2
 	case modeAbsoluteX:
-		offset := c.readWord(c.pc + 1)
-		address = offset + uint16(c.x)
-		if pageCrossed(offset, address) && !noPageCrossed {
-			c.cycles++
-		}
+		address = c.index(c.readWord(c.pc), c.x, inst.pagePenalty)
+		c.pc += 2
 	case modeZeroPageX:
-		address = uint16(c.readByte(c.pc+1)+c.x) & 0xff
+		pointer := c.read(c.pc)
+		c.pc++
+		c.read(uint16(pointer))
+		address = uint16(pointer + c.x)
 	case modeZeroPageY:
-		address = uint16(c.readByte(c.pc+1)+c.y) & 0xff
+		pointer := c.read(c.pc)
+		c.pc++
+		c.read(uint16(pointer))
+		address = uint16(pointer + c.y)
+	}
+	inst.handler(c, address)
+}
+
+// index adds index to base. The cpu adds the low bytes first
+// and reads from that address while it fixes the high byte.
+// Reads skip that dummy read when the page isn't crossed.
+func (c *cpu) index(base uint16, index byte, read bool) uint16 {
+	address := base + uint16(index)
+	if pageCrossed(base, address) || !read {
+		c.read(base&0xFF00 | address&0xFF)
 	}
-	c.pc += bytes
-	inst(address)
-	return int(c.cycles - cycles)
+	return address
 }
 
 // a page is 256 bytes. The high byte is the page
@@ -1425,9 +550,16 @@ func (c *cpu) pushWord(value uint16) {
 	c.push(low)
 }
 
+// peekStack is the dummy read of the top of the stack
+// done while the stack pointer is incremented or a
+// return address is pushed
+func (c *cpu) peekStack() {
+	c.read(0x100 | uint16(c.sp))
+}
+
 func (c *cpu) pull() byte {
 	c.sp++
-	return c.readByte(0x100 | uint16(c.sp))
+	return c.read(0x100 | uint16(c.sp))
 }
 
 func (c *cpu) pullWord() uint16 {
@@ -1441,7 +573,7 @@ func (c *cpu) jmp(address uint16) {
 }
 
 func (c *cpu) ldx(address uint16) {
-	c.x = c.readByte(address)
+	c.x = c.read(address)
 	c.setZ(c.x)
 	c.setN(c.x)
 }
@@ -1455,6 +587,7 @@ func (c *cpu) sty(address uint16) {
 }
 
 func (c *cpu) jsr(address uint16) {
+	c.peekStack()
 	c.pushWord(c.pc - 1)
 	c.pc = address
 }
@@ -1462,71 +595,78 @@ func (c *cpu) jsr(address uint16) {
 func (c *cpu) nop(address uint16) {
 }
 
+// the NOPs with an operand read it and ignore the value
+func (c *cpu) nopRead(address uint16) {
+	c.read(address)
+}
+
 func (c *cpu) sec(address uint16) {
 	c.status = setBits(c.status, cpuFlagC)
 }
 
-func (c *cpu) addBranchCycles(address uint16) {
+// branch jumps to address. Taking the branch reads the next
+// opcode while the offset is added and crossing a page reads
+// from the wrong page while the high byte is fixed.
+func (c *cpu) branch(address uint16) {
 	crossed := pageCrossed(c.pc, address)
-	c.cycles++
+	if !crossed {
+		// interrupts are polled before the second
+		// last cycle instead of the last
+		c.pollInterrupts(c.status)
+		c.poll = pollNone
+	}
+	c.read(c.pc)
 	if crossed {
-		c.cycles++
+		c.read(c.pc&0xFF00 | address&0xFF)
 	}
+	c.pc = address
 }
 
 func (c *cpu) bcs(address uint16) {
 	if isAnySet(c.status, cpuFlagC) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) bcc(address uint16) {
 	if !isAnySet(c.status, cpuFlagC) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) beq(address uint16) {
 	if isAnySet(c.status, cpuFlagZ) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) bne(address uint16) {
 	if !isAnySet(c.status, cpuFlagZ) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) bvs(address uint16) {
 	if isAnySet(c.status, cpuFlagV) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) bvc(address uint16) {
 	if !isAnySet(c.status, cpuFlagV) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) bpl(address uint16) {
 	if !isAnySet(c.status, cpuFlagN) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
 func (c *cpu) bmi(address uint16) {
 	if isAnySet(c.status, cpuFlagN) {
-		c.addBranchCycles(address)
-		c.pc = address
+		c.branch(address)
 	}
 }
 
@@ -1535,13 +675,13 @@ func (c *cpu) clc(address uint16) {
 }
 
 func (c *cpu) lda(address uint16) {
-	c.a = c.readByte(address)
+	c.a = c.read(address)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
 func (c *cpu) ldy(address uint16) {
-	c.y = c.readByte(address)
+	c.y = c.read(address)
 	c.setZ(c.y)
 	c.setN(c.y)
 }
@@ -1551,7 +691,7 @@ func (c *cpu) sta(address uint16) {
 }
 
 func (c *cpu) bit(address uint16) {
-	value := c.readByte(address)
+	value := c.read(address)
 	if (value>>6)&1 == 1 {
 		c.status = setBits(c.status, cpuFlagV)
 	} else {
@@ -1562,11 +702,21 @@ func (c *cpu) bit(address uint16) {
 }
 
 func (c *cpu) rts(address uint16) {
-	c.pc = c.pullWord() + 1
+	c.peekStack()
+	c.pc = c.pullWord()
+	// pc is read while it's incremented
+	c.read(c.pc)
+	c.pc++
+}
+
+func (c *cpu) cli(address uint16) {
+	c.status = resetBits(c.status, cpuFlagI)
+	c.poll = pollOldMask
 }
 
 func (c *cpu) sei(address uint16) {
 	c.status = setBits(c.status, cpuFlagI)
+	c.poll = pollOldMask
 }
 
 func (c *cpu) sed(address uint16) {
@@ -1587,18 +737,27 @@ func (c *cpu) pha(address uint16) {
 }
 
 func (c *cpu) pla(address uint16) {
+	c.peekStack()
 	c.a = c.pull()
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
 func (c *cpu) plp(address uint16) {
+	c.peekStack()
 	// ignore bit 5
 	c.status = c.pull()&0xEF | 0x20
+	c.poll = pollOldMask
+}
+
+// BRK skips the byte after it
+func (c *cpu) brk(address uint16) {
+	c.pc++
+	c.interrupt(interruptBRK)
 }
 
 func (c *cpu) and(address uint16) {
-	c.a &= c.readByte(address)
+	c.a &= c.read(address)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
@@ -1615,19 +774,19 @@ func (c *cpu) compare(a, b byte) {
 }
 
 func (c *cpu) cmp(address uint16) {
-	c.compare(c.a, c.readByte(address))
+	c.compare(c.a, c.read(address))
 }
 
 func (c *cpu) cpy(address uint16) {
-	c.compare(c.y, c.readByte(address))
+	c.compare(c.y, c.read(address))
 }
 
 func (c *cpu) cpx(address uint16) {
-	c.compare(c.x, c.readByte(address))
+	c.compare(c.x, c.read(address))
 }
 
 func (c *cpu) ora(address uint16) {
-	c.a |= c.readByte(address)
+	c.a |= c.read(address)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
@@ -1637,14 +796,18 @@ func (c *cpu) clv(address uint16) {
 }
 
 func (c *cpu) eor(address uint16) {
-	c.a ^= c.readByte(address)
+	c.a ^= c.read(address)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
 func (c *cpu) adc(address uint16) {
+	c.add(c.read(address))
+}
+
+// add adds b and the carry to A, SBC adds the complement
+func (c *cpu) add(b byte) {
 	a := c.a
-	b := c.readByte(address)
 	carry := c.status & 1
 	c.a = a + b + carry
 	c.setZ(c.a)
@@ -1667,23 +830,7 @@ func (c *cpu) adc(address uint16) {
 }
 
 func (c *cpu) sbc(address uint16) {
-	a := c.a
-	b := c.readByte(address)
-	carry := c.status & 1
-	c.a = a - b - (1 - carry)
-	c.setZ(c.a)
-	c.setN(c.a)
-	if int(a)-int(b)-int(1-carry) >= 0 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-
-	if (a^b)&0x80 != 0 && (a^c.a)&0x80 != 0 {
-		c.status = setBits(c.status, cpuFlagV)
-	} else {
-		c.status = resetBits(c.status, cpuFlagV)
-	}
+	c.add(^c.read(address))
 }
 
 func (c *cpu) iny(address uint16) {
@@ -1745,129 +892,111 @@ func (c *cpu) txs(address uint16) {
 }
 
 func (c *cpu) rti(address uint16) {
+	c.peekStack()
 	c.status = c.pull()&0xEF | 0x20
 	c.pc = c.pullWord()
 }
 
 func (c *cpu) lsra(address uint16) {
-	if c.a&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	c.a >>= 1
+	c.a = c.shiftRight(c.a)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
-func (c *cpu) rora(address uint16) {
-	carry := c.status & 1
-	if c.a&1 == 1 {
+// modify reads the operand of a read-modify-write
+// instruction. The value is written back unchanged while
+// the result is worked out, so mappers see two writes.
+func (c *cpu) modify(address uint16) byte {
+	value := c.read(address)
+	c.write(address, value)
+	return value
+}
+
+// store writes the result of a read-modify-write
+// instruction and sets Z and N from it
+func (c *cpu) store(address uint16, value byte) {
+	c.write(address, value)
+	c.setZ(value)
+	c.setN(value)
+}
+
+func (c *cpu) setC(set bool) {
+	if set {
 		c.status = setBits(c.status, cpuFlagC)
 	} else {
 		c.status = resetBits(c.status, cpuFlagC)
 	}
-	c.a = (c.a >> 1) | (carry << 7)
+}
+
+func (c *cpu) shiftLeft(value byte) byte {
+	c.setC(value&0x80 != 0)
+	return value << 1
+}
+
+func (c *cpu) shiftRight(value byte) byte {
+	c.setC(value&1 != 0)
+	return value >> 1
+}
+
+func (c *cpu) rotateLeft(value byte) byte {
+	carry := c.status & 1
+	c.setC(value&0x80 != 0)
+	return value<<1 | carry
+}
+
+func (c *cpu) rotateRight(value byte) byte {
+	carry := c.status & 1
+	c.setC(value&1 != 0)
+	return value>>1 | carry<<7
+}
+
+func (c *cpu) rora(address uint16) {
+	c.a = c.rotateRight(c.a)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
 func (c *cpu) ror(address uint16) {
-	value := c.readByte(address)
-	carry := c.status & 1
-	if value&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	value = (value >> 1) | (carry << 7)
-	c.write(address, value)
-	c.setZ(value)
-	c.setN(value)
+	c.store(address, c.rotateRight(c.modify(address)))
 }
 
 func (c *cpu) rola(address uint16) {
-	carry := c.status & 1
-	if (c.a>>7)&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	c.a = (c.a << 1) | carry
+	c.a = c.rotateLeft(c.a)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
 func (c *cpu) rol(address uint16) {
-	value := c.readByte(address)
-	carry := c.status & 1
-	if (value>>7)&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	value = (value << 1) | carry
-	c.write(address, value)
-	c.setZ(value)
-	c.setN(value)
+	c.store(address, c.rotateLeft(c.modify(address)))
 }
 
 func (c *cpu) lsr(address uint16) {
-	value := c.readByte(address)
-	if value&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	value >>= 1
-	c.write(address, value)
-	c.setZ(value)
-	c.setN(value)
+	c.store(address, c.shiftRight(c.modify(address)))
 }
 
 func (c *cpu) asla(address uint16) {
-	if (c.a>>7)&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	c.a <<= 1
+	c.a = c.shiftLeft(c.a)
 	c.setZ(c.a)
 	c.setN(c.a)
 }
 
 func (c *cpu) asl(address uint16) {
-	value := c.readByte(address)
-	if (value>>7)&1 == 1 {
-		c.status = setBits(c.status, cpuFlagC)
-	} else {
-		c.status = resetBits(c.status, cpuFlagC)
-	}
-	value <<= 1
-	c.write(address, value)
-	c.setZ(value)
-	c.setN(value)
+	c.store(address, c.shiftLeft(c.modify(address)))
 }
 
 func (c *cpu) inc(address uint16) {
-	value := c.readByte(address)
-	value++
-	c.setZ(value)
-	c.setN(value)
-	c.write(address, value)
+	c.store(address, c.modify(address)+1)
 }
 
 func (c *cpu) dec(address uint16) {
-	value := c.readByte(address)
-	value--
-	c.setZ(value)
-	c.setN(value)
-	c.write(address, value)
+	c.store(address, c.modify(address)-1)
 }
 
 func (c *cpu) lax(address uint16) {
-	c.lda(address)
-	c.ldx(address)
+	c.a = c.read(address)
+	c.x = c.a
+	c.setZ(c.a)
+	c.setN(c.a)
 }
 
 func (c *cpu) sax(address uint16) {
@@ -1875,31 +1004,136 @@ func (c *cpu) sax(address uint16) {
 }
 
 func (c *cpu) dcp(address uint16) {
-	c.dec(address)
-	c.cmp(address)
+	value := c.modify(address) - 1
+	c.write(address, value)
+	c.compare(c.a, value)
 }
 
 func (c *cpu) isc(address uint16) {
-	c.inc(address)
-	c.sbc(address)
+	value := c.modify(address) + 1
+	c.write(address, value)
+	c.add(^value)
 }
 
 func (c *cpu) slo(address uint16) {
-	c.asl(address)
-	c.ora(address)
+	value := c.shiftLeft(c.modify(address))
+	c.write(address, value)
+	c.a |= value
+	c.setZ(c.a)
+	c.setN(c.a)
 }
 
 func (c *cpu) rla(address uint16) {
-	c.rol(address)
-	c.and(address)
+	value := c.rotateLeft(c.modify(address))
+	c.write(address, value)
+	c.a &= value
+	c.setZ(c.a)
+	c.setN(c.a)
 }
 
 func (c *cpu) sre(address uint16) {
-	c.lsr(address)
-	c.eor(address)
+	value := c.shiftRight(c.modify(address))
+	c.write(address, value)
+	c.a ^= value
+	c.setZ(c.a)
+	c.setN(c.a)
 }
 
 func (c *cpu) rra(address uint16) {
-	c.ror(address)
-	c.adc(address)
+	value := c.rotateRight(c.modify(address))
+	c.write(address, value)
+	c.add(value)
+}
+
+func (c *cpu) anc(address uint16) {
+	c.and(address)
+	c.setC(c.a&0x80 != 0)
+}
+
+func (c *cpu) alr(address uint16) {
+	c.and(address)
+	c.lsra(address)
+}
+
+// ARR is AND then ROR A except C comes from bit 6 of
+// the result and V from bit 6 xor bit 5
+func (c *cpu) arr(address uint16) {
+	c.and(address)
+	c.rora(address)
+	c.setC(c.a&0x40 != 0)
+	if (c.a>>6^c.a>>5)&1 != 0 {
+		c.status = setBits(c.status, cpuFlagV)
+	} else {
+		c.status = resetBits(c.status, cpuFlagV)
+	}
+}
+
+// AXS subtracts from A AND X into X without borrow,
+// setting the flags like CMP
+func (c *cpu) axs(address uint16) {
+	value := c.read(address)
+	c.compare(c.a&c.x, value)
+	c.x = c.a&c.x - value
+}
+
+// XAA and LXA depend on analog effects that vary between
+// consoles. Most behave as if A were ORed with 0xEE first.
+const unstableMagic = 0xEE
+
+func (c *cpu) xaa(address uint16) {
+	c.a = (c.a | unstableMagic) & c.x & c.read(address)
+	c.setZ(c.a)
+	c.setN(c.a)
+}
+
+func (c *cpu) lxa(address uint16) {
+	c.a = (c.a | unstableMagic) & c.read(address)
+	c.x = c.a
+	c.setZ(c.a)
+	c.setN(c.a)
+}
+
+func (c *cpu) las(address uint16) {
+	c.sp &= c.read(address)
+	c.a = c.sp
+	c.x = c.sp
+	c.setZ(c.a)
+	c.setN(c.a)
+}
+
+// storeHigh is the store done by SHA, SHX, SHY and TAS.
+// The value is ANDed with the high byte of the base address
+// plus one. If indexing crossed a page the high byte of the
+// address is replaced by the value too.
+func (c *cpu) storeHigh(address uint16, index, value byte) {
+	base := address - uint16(index)
+	value &= byte(base>>8) + 1
+	if pageCrossed(base, address) {
+		address = uint16(value)<<8 | address&0xFF
+	}
+	c.write(address, value)
+}
+
+func (c *cpu) sha(address uint16) {
+	c.storeHigh(address, c.y, c.a&c.x)
+}
+
+func (c *cpu) shx(address uint16) {
+	c.storeHigh(address, c.y, c.x)
+}
+
+func (c *cpu) shy(address uint16) {
+	c.storeHigh(address, c.x, c.y)
+}
+
+func (c *cpu) tas(address uint16) {
+	c.sp = c.a & c.x
+	c.storeHigh(address, c.y, c.sp)
+}
+
+// jam locks up the cpu, only a reset recovers it.
+// The console halts with an error instead.
+func (c *cpu) jam(address uint16) {
+	c.pc--
+	c.err = errors.Errorf("cpu jammed at %04X", c.pc)
 }
@@ -2,11 +2,13 @@ package nes
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"image"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLogFile(t *testing.T) {
@@ -15,12 +17,13 @@ func TestLogFile(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer file.Close()
-	cart, err := readFile(file)
+	cart, _, err := readFile(file)
 	if err != nil {
 		t.Fatal(err)
 	}
 	ppu := newPPU(cart)
-	cpu := newCPU(cart, ppu, &joypad{})
+	cpu := newCPU(cart, ppu)
+	cpu.reset()
 	// nestest automation mode starts at 0xC000
 	cpu.pc = 0xC000
 
@@ -49,7 +52,7 @@ func TestLogFile(t *testing.T) {
 		expectedOpcode := text[6:8]
 		actualOpcode := fmt.Sprintf("%02X", cpu.readByte(cpu.pc))
 		if expectedOpcode != actualOpcode {
-			t.Fatalf("opcode = %v, want %v", expectedOpcode, actualOpcode)
+			t.Fatalf("opcode = %v (%s), want %v", actualOpcode, cpu.disassemble(cpu.pc), expectedOpcode)
 		}
 
 		expectedA := text[50:52]
@@ -108,3 +111,619 @@ func TestLogFile(t *testing.T) {
 		}
 	}
 }
+
+func TestInstructionTable(t *testing.T) {
+	sizes := map[int]uint16{
+		modeAccumulator:     1,
+		modeImplied:         1,
+		modeImmediate:       2,
+		modeIndexedIndirect: 2,
+		modeIndirectIndexed: 2,
+		modeRelative:        2,
+		modeZeroPage:        2,
+		modeZeroPageX:       2,
+		modeZeroPageY:       2,
+		modeAbsolute:        3,
+		modeAbsoluteX:       3,
+		modeAbsoluteY:       3,
+		modeIndirect:        3,
+	}
+	for opcode, inst := range instructions {
+		if inst.handler == nil {
+			t.Errorf("%02X has no handler", opcode)
+			continue
+		}
+		if inst.size != sizes[inst.mode] {
+			t.Errorf("%02X %s size = %d, want %d", opcode, inst.name, inst.size, sizes[inst.mode])
+		}
+		if inst.pagePenalty && inst.mode != modeAbsoluteX && inst.mode != modeAbsoluteY && inst.mode != modeIndirectIndexed {
+			t.Errorf("%02X %s can't cross a page", opcode, inst.name)
+		}
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	c := runInstruction(t, func(c *cpu) {}, 0x0A, 0x6A)
+	if s := c.disassemble(0x8000); s != "ASL A" {
+		t.Errorf("disassemble(8000) = %q, want ASL A", s)
+	}
+	if s := c.disassemble(0x8001); s != "ROR A" {
+		t.Errorf("disassemble(8001) = %q, want ROR A", s)
+	}
+	// looking at a register doesn't read it
+	c.ppu.status |= statusV
+	c.disassemble(0x2002)
+	if c.ppu.status&statusV == 0 {
+		t.Error("disassemble cleared vblank")
+	}
+}
+
+// runInstruction runs the first instruction of program
+// after setup has initialised the cpu
+func runInstruction(t *testing.T, setup func(c *cpu), program ...byte) *cpu {
+	c, err := NewConsole(bytes.NewReader(testROM(0, program...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	setup(c.cpu)
+	c.cpu.Step()
+	return c.cpu
+}
+
+func TestUnofficialOpcodes(t *testing.T) {
+	// ANC #$80 copies N into C
+	c := runInstruction(t, func(c *cpu) { c.a = 0xFF }, 0x0B, 0x80)
+	if c.a != 0x80 || c.status&cpuFlagC == 0 {
+		t.Errorf("ANC a = %02X, status = %02X", c.a, c.status)
+	}
+
+	// ARR #$FF takes C from bit 6 and V from bit 6 xor 5
+	c = runInstruction(t, func(c *cpu) { c.a = 0xC0 }, 0x6B, 0xFF)
+	if c.a != 0x60 || c.status&cpuFlagC == 0 || c.status&cpuFlagV != 0 {
+		t.Errorf("ARR a = %02X, status = %02X", c.a, c.status)
+	}
+
+	// AXS #$01 borrows
+	c = runInstruction(t, func(c *cpu) { c.a, c.x = 0xF0, 0x0F }, 0xCB, 0x01)
+	if c.x != 0xFF || c.status&cpuFlagC != 0 {
+		t.Errorf("AXS x = %02X, status = %02X", c.x, c.status)
+	}
+
+	// LAS $0200,Y
+	c = runInstruction(t, func(c *cpu) {
+		c.sp = 0xF0
+		c.ram[0x200] = 0x3F
+	}, 0xBB, 0x00, 0x02)
+	if c.a != 0x30 || c.x != 0x30 || c.sp != 0x30 {
+		t.Errorf("LAS a = %02X, x = %02X, sp = %02X", c.a, c.x, c.sp)
+	}
+
+	// SHX $0200,Y stores X AND 3
+	c = runInstruction(t, func(c *cpu) { c.x = 0xFF }, 0x9E, 0x00, 0x02)
+	if c.ram[0x200] != 0x03 {
+		t.Errorf("SHX stored %02X, want 03", c.ram[0x200])
+	}
+
+	// SHX $02FF,Y crosses into page 3 so X AND 3
+	// also becomes the high byte of the address
+	c = runInstruction(t, func(c *cpu) { c.x, c.y = 0x01, 0x01 }, 0x9E, 0xFF, 0x02)
+	if c.ram[0x100] != 0x01 || c.ram[0x300] != 0 {
+		t.Errorf("SHX stored %02X at 0100 and %02X at 0300", c.ram[0x100], c.ram[0x300])
+	}
+	// after the 7 cycles of reset
+	if c.cycles != 7+5 {
+		t.Errorf("SHX took %d cycles, want 5", c.cycles-7)
+	}
+
+	// ALR #$03 shifts bit 0 into C
+	c = runInstruction(t, func(c *cpu) { c.a = 0xFF }, 0x4B, 0x03)
+	if c.a != 0x01 || c.status&cpuFlagC == 0 {
+		t.Errorf("ALR a = %02X, status = %02X", c.a, c.status)
+	}
+
+	// ARR #$FF with C set and bits 6 and 5 different sets V
+	c = runInstruction(t, func(c *cpu) {
+		c.a = 0x40
+		c.status = setBits(c.status, cpuFlagC)
+	}, 0x6B, 0xFF)
+	if c.a != 0xA0 || c.status&cpuFlagV == 0 || c.status&cpuFlagC != 0 || c.status&cpuFlagN == 0 {
+		t.Errorf("ARR a = %02X, status = %02X", c.a, c.status)
+	}
+
+	// TAS $0200,Y puts A AND X in SP and stores it AND 3
+	c = runInstruction(t, func(c *cpu) { c.a, c.x = 0xF3, 0x3F }, 0x9B, 0x00, 0x02)
+	if c.sp != 0x33 || c.ram[0x200] != 0x03 {
+		t.Errorf("TAS sp = %02X, stored %02X", c.sp, c.ram[0x200])
+	}
+
+	// SHY $0200,X stores Y AND 3
+	c = runInstruction(t, func(c *cpu) { c.y = 0xFF }, 0x9C, 0x00, 0x02)
+	if c.ram[0x200] != 0x03 {
+		t.Errorf("SHY stored %02X, want 03", c.ram[0x200])
+	}
+}
+
+func TestExecuteOpenBus(t *testing.T) {
+	// push $8020 and a status, then JMP $4020. Nothing
+	// answers there so the opcode is the $40 left on the
+	// bus by the JMP, which is RTI.
+	c := interruptConsole(t,
+		0xA9, 0x80, 0x48, // LDA #$80; PHA
+		0xA9, 0x20, 0x48, // LDA #$20; PHA
+		0xA9, 0x00, 0x48, // LDA #$00; PHA
+		0x4C, 0x20, 0x40, // JMP $4020
+	)
+	for i := 0; i < 8; i++ {
+		c.cpu.Step()
+	}
+	if c.cpu.pc != 0x8020 || c.cpu.sp != 0xFD {
+		t.Fatalf("pc = %04X, sp = %02X after RTI from open bus", c.cpu.pc, c.cpu.sp)
+	}
+	if c.cpu.err != nil {
+		t.Fatal(c.cpu.err)
+	}
+}
+
+func TestInstructionCycles(t *testing.T) {
+	for opcode, inst := range instructions {
+		if inst.mode == modeRelative {
+			continue
+		}
+		// $0200,X doesn't cross a page, $02FF,X does
+		cycles := runInstruction(t, func(c *cpu) {}, byte(opcode), 0x00, 0x02).cycles - 7
+		if cycles != inst.cycles {
+			t.Errorf("%02X %s took %d cycles, want %d", opcode, inst.name, cycles, inst.cycles)
+		}
+		if !inst.pagePenalty {
+			continue
+		}
+		// ($FF),Y points at $02FF too
+		cycles = runInstruction(t, func(c *cpu) {
+			c.x, c.y = 0xFF, 0xFF
+			c.ram[0xFF], c.ram[0] = 0xFF, 0x02
+		}, byte(opcode), 0xFF, 0x02).cycles - 7
+		if want := inst.cycles + 1; cycles != want {
+			t.Errorf("%02X %s crossing a page took %d cycles, want %d", opcode, inst.name, cycles, want)
+		}
+	}
+}
+
+func TestDummyRead(t *testing.T) {
+	// LDA $20FF,X reads $2002 before $2102 so the
+	// second read sees vblank already cleared
+	c := runInstruction(t, func(c *cpu) {
+		c.x = 3
+		c.ppu.status = setBits(c.ppu.status, statusV)
+	}, 0xBD, 0xFF, 0x20)
+	if c.a&statusV != 0 {
+		t.Fatalf("a = %02X, want vblank clear", c.a)
+	}
+}
+
+func TestDummyReadWithoutCrossing(t *testing.T) {
+	// STA $2002,X always reads $2002 first, clearing vblank
+	c := runInstruction(t, func(c *cpu) {
+		c.ppu.status = setBits(c.ppu.status, statusV)
+	}, 0x9D, 0x02, 0x20)
+	if c.ppu.status&statusV != 0 {
+		t.Error("STA $2002,X didn't read $2002")
+	}
+	// LDA $2002,X without crossing a page reads once
+	c = runInstruction(t, func(c *cpu) {
+		c.ppu.status = setBits(c.ppu.status, statusV)
+	}, 0xBD, 0x02, 0x20)
+	if c.a&statusV == 0 {
+		t.Error("LDA $2002,X read $2002 twice")
+	}
+	// LDA ($00),Y crossing a page reads the wrong page first
+	c = runInstruction(t, func(c *cpu) {
+		c.ram[0], c.ram[1] = 0xFF, 0x20
+		c.y = 3
+		c.ppu.status = setBits(c.ppu.status, statusV)
+	}, 0xB1, 0x00)
+	if c.a&statusV != 0 {
+		t.Error("LDA ($00),Y didn't read $2002 first")
+	}
+}
+
+func TestDummyWrites(t *testing.T) {
+	// INC $2007 reads then writes the old value and the new
+	// one, each moving the VRAM address on
+	c := runInstruction(t, func(c *cpu) {
+		c.ppu.v = 0x2400
+		c.ppu.readBuffer = 0x41
+		c.ppu.vram[c.ppu.cart.mirror(0x2400)] = 0x10
+	}, 0xEE, 0x07, 0x20)
+	vram := func(address uint16) byte {
+		return c.ppu.vram[c.ppu.cart.mirror(address)]
+	}
+	if vram(0x2401) != 0x41 || vram(0x2402) != 0x42 || c.ppu.v != 0x2403 {
+		t.Errorf("INC $2007 wrote %02X %02X, v = %04X", vram(0x2401), vram(0x2402), c.ppu.v)
+	}
+	if c.ppu.readBuffer != 0x10 {
+		t.Errorf("read buffer = %02X, want 10", c.ppu.readBuffer)
+	}
+
+	// ASL $2004 writes OAM twice
+	c = runInstruction(t, func(c *cpu) {
+		c.ppu.oamAddr = 0x10
+		c.ppu.oamData[0x10] = 0x05
+	}, 0x0E, 0x04, 0x20)
+	if c.ppu.oamData[0x10] != 0x05 || c.ppu.oamData[0x11] != 0x0A || c.ppu.oamAddr != 0x12 {
+		t.Errorf("ASL $2004 wrote %02X %02X, oamAddr = %02X", c.ppu.oamData[0x10], c.ppu.oamData[0x11], c.ppu.oamAddr)
+	}
+}
+
+func TestOAMDMA(t *testing.T) {
+	// LDA #$02; STA $4014; NOP
+	c, err := NewConsole(bytes.NewReader(testROM(0, 0xA9, 0x02, 0x8D, 0x14, 0x40, 0xEA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range c.cpu.ram[0x200:0x300] {
+		c.cpu.ram[0x200+i] = byte(i)
+	}
+	c.cpu.Step()
+	c.cpu.Step()
+	dots := c.ppu.cycle + c.ppu.scanline*341
+	// the DMA halts the NOP's opcode fetch
+	cycles := c.cpu.Step()
+	if cycles != 2+513 && cycles != 2+514 {
+		t.Fatalf("NOP took %d cycles, want 515 or 516", cycles)
+	}
+	// the PPU keeps running during the DMA
+	if ran := c.ppu.cycle + c.ppu.scanline*341 - dots; ran != cycles*3 {
+		t.Errorf("PPU ran %d dots, want %d", ran, cycles*3)
+	}
+	// attribute bytes lose their unused bits
+	for i, value := range c.ppu.oamData {
+		want := byte(i)
+		if i%4 == 2 {
+			want &= 0xE3
+		}
+		if value != want {
+			t.Fatalf("OAM[%d] = %02X, want %02X", i, value, want)
+		}
+	}
+}
+
+// oamDMALength runs an OAM DMA after skip cycles and
+// returns how many cycles it halted the cpu for
+func oamDMALength(t *testing.T, skip int, tick func(c *Console)) uint64 {
+	c, err := NewConsole(bytes.NewReader(testROM(0, 0xEA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range c.cpu.ram[0x200:0x300] {
+		c.cpu.ram[0x200+i] = byte(i)
+	}
+	for i := 0; i < skip; i++ {
+		c.cpu.read(0)
+	}
+	if tick != nil {
+		next := c.cpu.tick
+		c.cpu.tick = func() {
+			next()
+			tick(c)
+		}
+	}
+	c.cpu.oamDMA = true
+	c.cpu.oamDMAPage = 0x02
+	start := c.cpu.cycles
+	c.cpu.read(0)
+	return c.cpu.cycles - start - 1
+}
+
+func TestOAMDMASync(t *testing.T) {
+	// the length depends on whether the DMA starts on a
+	// get or put cycle, which lets a ROM sync to the APU
+	even, odd := oamDMALength(t, 0, nil), oamDMALength(t, 1, nil)
+	if even+odd != 513+514 {
+		t.Errorf("DMA took %d and %d cycles, want 513 and 514", even, odd)
+	}
+	if other := oamDMALength(t, 2, nil); other != even {
+		t.Errorf("DMA took %d cycles two cycles later, want %d", other, even)
+	}
+}
+
+func TestDMCDuringOAMDMA(t *testing.T) {
+	// a DMC DMA in the middle of an OAM DMA takes a get
+	// cycle and makes the OAM DMA realign, adding two
+	for skip := 0; skip < 2; skip++ {
+		base := oamDMALength(t, skip, nil)
+		var c *Console
+		cycles := oamDMALength(t, skip, func(console *Console) {
+			c = console
+			if c.cpu.ticked == 200 {
+				d := &c.apu.dmc
+				d.currentAddress = 0x8000
+				d.bytesRemaining = 1
+				c.cpu.requestDMC()
+			}
+		})
+		if cycles != base+2 {
+			t.Errorf("DMA took %d cycles, want %d", cycles, base+2)
+		}
+		if c.apu.dmc.bufferEmpty || c.apu.dmc.buffer != 0xEA {
+			t.Errorf("sample buffer = %02X, want EA", c.apu.dmc.buffer)
+		}
+		if c.ppu.oamData[0xFF] != 0xFF {
+			t.Errorf("OAM[255] = %02X, want FF", c.ppu.oamData[0xFF])
+		}
+	}
+}
+
+func TestDMCDMA(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0, 0xEA)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &c.apu.dmc
+	d.currentAddress = 0x8000
+	d.bytesRemaining = 2
+
+	// the halted read of $4016 clocks the joypad
+	// too, so A is lost and B is read instead
+	c.SetJoypad(Player1, ButtonA, true)
+	c.cpu.writeByte(0x4016, 1)
+	c.cpu.writeByte(0x4016, 0)
+	c.cpu.requestDMC()
+	start := c.cpu.cycles
+	if value := c.cpu.read(0x4016); value&1 != 0 {
+		t.Errorf("read A = %d, want B", value&1)
+	}
+	if cycles := c.cpu.cycles - start; cycles != 1+3 && cycles != 1+4 {
+		t.Errorf("read took %d cycles, want 4 or 5", cycles)
+	}
+	if d.bufferEmpty || d.buffer != 0xEA {
+		t.Fatalf("sample buffer = %02X, want EA", d.buffer)
+	}
+
+	// $2007 is read on every cycle the cpu waits
+	d.bufferEmpty = true
+	c.cpu.requestDMC()
+	c.cpu.read(0x2007)
+	if c.ppu.v < 3 {
+		t.Errorf("v = %04X, want at least 3 reads", c.ppu.v)
+	}
+}
+
+// expansionCart is NROM with a register at $5000
+type expansionCart struct {
+	cartridge
+	register byte
+}
+
+func (e *expansionCart) readExpansion(address uint16) byte {
+	return e.register
+}
+
+func (e *expansionCart) writeExpansion(address uint16, value byte) {
+	e.register = value
+}
+
+func TestCPUOpenBus(t *testing.T) {
+	c := runInstruction(t, func(c *cpu) {}, 0xAD, 0x00, 0x50)
+	// nothing is at $5000 so LDA reads the high byte of its operand
+	if c.a != 0x50 {
+		t.Errorf("LDA $5000 = %02X, want 50", c.a)
+	}
+	// the write only APU registers too
+	c = runInstruction(t, func(c *cpu) {}, 0xAD, 0x00, 0x40)
+	if c.a != 0x40 {
+		t.Errorf("LDA $4000 = %02X, want 40", c.a)
+	}
+	// and the upper bits of the controller ports
+	c = runInstruction(t, func(c *cpu) { c.ports[0].Write(1) }, 0xAD, 0x16, 0x40)
+	if c.a != 0x40 {
+		t.Errorf("LDA $4016 = %02X, want 40", c.a)
+	}
+	// as does PRG RAM the board doesn't have, including
+	// the dummy read of a page crossing
+	c = runInstruction(t, func(c *cpu) {}, 0xAD, 0x00, 0x60)
+	if c.a != 0x60 || c.cart.fault() != nil {
+		t.Errorf("LDA $6000 = %02X, err = %v", c.a, c.cart.fault())
+	}
+	c = runInstruction(t, func(c *cpu) { c.x = 0x20 }, 0xBD, 0xF0, 0x60)
+	if c.a != 0x60 || c.cart.fault() != nil {
+		t.Errorf("LDA $60F0,X = %02X, err = %v", c.a, c.cart.fault())
+	}
+	// $4015 only drives the bits it uses
+	c = runInstruction(t, func(c *cpu) {}, 0xAD, 0x15, 0x40)
+	if c.a != 0x00 || c.bus != 0x40 {
+		t.Errorf("LDA $4015 = %02X, bus = %02X", c.a, c.bus)
+	}
+
+	// cartridges with expansion hardware see the accesses
+	e := &expansionCart{}
+	c = runInstruction(t, func(c *cpu) {
+		e.cartridge = c.cart
+		c.cart = e
+		c.expansion = e
+		c.a = 0x12
+	}, 0x8D, 0x00, 0x50)
+	if e.register != 0x12 {
+		t.Errorf("expansion register = %02X, want 12", e.register)
+	}
+}
+
+// interruptConsole runs program with the NMI handler
+// at $8020 and the IRQ/BRK handler at $8010
+func interruptConsole(t *testing.T, program ...byte) *Console {
+	rom := testROM(0, program...)
+	rom[16+0x3FFA] = 0x20
+	rom[16+0x3FFB] = 0x80
+	rom[16+0x3FFE] = 0x10
+	rom[16+0x3FFF] = 0x80
+	c, err := NewConsole(bytes.NewReader(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestBRK(t *testing.T) {
+	c := interruptConsole(t, 0x00)
+	c.cpu.Step()
+	if c.cpu.pc != 0x8010 {
+		t.Fatalf("pc = %04X, want 8010", c.cpu.pc)
+	}
+	// BRK returns past its padding byte and pushes B
+	if pc := uint16(c.cpu.ram[0x1FD])<<8 | uint16(c.cpu.ram[0x1FC]); pc != 0x8002 {
+		t.Errorf("pushed pc = %04X, want 8002", pc)
+	}
+	if status := c.cpu.ram[0x1FB]; status != 0x34 {
+		t.Errorf("pushed status = %02X, want 34", status)
+	}
+
+	// an NMI during BRK hijacks its vector but B is still pushed
+	c = interruptConsole(t, 0x00)
+	c.ppu.nmiEdge = true
+	c.cpu.Step()
+	if c.cpu.pc != 0x8020 || c.cpu.ram[0x1FB] != 0x34 {
+		t.Errorf("pc = %04X, pushed status = %02X", c.cpu.pc, c.cpu.ram[0x1FB])
+	}
+	if c.cpu.nmiTriggered || c.ppu.nmiEdge {
+		t.Error("hijacking NMI should be serviced")
+	}
+}
+
+func TestIRQ(t *testing.T) {
+	// CLI; NOP
+	c := interruptConsole(t, 0x58, 0xEA)
+	c.cpu.assertIRQ(irqMapper)
+	// CLI only unmasks IRQ after the next instruction
+	c.cpu.Step()
+	c.cpu.Step()
+	if c.cpu.pc != 0x8002 {
+		t.Fatalf("pc = %04X, want 8002", c.cpu.pc)
+	}
+	c.cpu.Step()
+	if c.cpu.pc != 0x8010 {
+		t.Fatalf("pc = %04X, want IRQ handler", c.cpu.pc)
+	}
+	// IRQ pushes B clear
+	if status := c.cpu.ram[0x1FB]; status != 0x20 {
+		t.Errorf("pushed status = %02X, want 20", status)
+	}
+
+	// CLI; SEI still takes the IRQ after SEI
+	c = interruptConsole(t, 0x58, 0x78)
+	c.cpu.Step()
+	c.cpu.assertIRQ(irqMapper)
+	c.cpu.Step()
+	c.cpu.Step()
+	if c.cpu.pc != 0x8010 {
+		t.Fatalf("pc = %04X, want IRQ handler", c.cpu.pc)
+	}
+}
+
+func TestInterruptLatency(t *testing.T) {
+	// LDA #$00; PHA; PLP; NOP with IRQ asserted: like CLI,
+	// PLP unmasks it after the next instruction
+	c := interruptConsole(t, 0xA9, 0x00, 0x48, 0x28, 0xEA)
+	c.cpu.assertIRQ(irqMapper)
+	for i := 0; i < 4; i++ {
+		c.cpu.Step()
+	}
+	if c.cpu.pc != 0x8005 {
+		t.Fatalf("PLP: pc = %04X, want 8005", c.cpu.pc)
+	}
+	c.cpu.Step()
+	if c.cpu.pc != 0x8010 {
+		t.Fatalf("PLP: pc = %04X, want IRQ handler", c.cpu.pc)
+	}
+
+	// but RTI unmasks it straight away. Push $8020 and a
+	// clear status, then RTI.
+	c = interruptConsole(t, 0xA9, 0x80, 0x48, 0xA9, 0x20, 0x48, 0xA9, 0x00, 0x48, 0x40)
+	c.cpu.assertIRQ(irqMapper)
+	for i := 0; i < 7; i++ {
+		c.cpu.Step()
+	}
+	if c.cpu.pc != 0x8020 {
+		t.Fatalf("RTI: pc = %04X, want 8020", c.cpu.pc)
+	}
+	c.cpu.Step()
+	if c.cpu.pc != 0x8010 {
+		t.Fatalf("RTI: pc = %04X, want IRQ handler", c.cpu.pc)
+	}
+}
+
+func TestNMIHijacksIRQ(t *testing.T) {
+	// CLI; NOP
+	c := interruptConsole(t, 0x58, 0xEA, 0xEA)
+	c.cpu.assertIRQ(irqMapper)
+	c.cpu.Step()
+	c.cpu.Step()
+	if !c.cpu.irqTriggered {
+		t.Fatal("expected an IRQ")
+	}
+	// an NMI before the status is pushed takes over the
+	// vector, and B is still clear
+	c.ppu.nmiEdge = true
+	c.cpu.Step()
+	if c.cpu.pc != 0x8020 {
+		t.Fatalf("pc = %04X, want NMI handler", c.cpu.pc)
+	}
+	if status := c.cpu.ram[0x1FB]; status&cpuFlagB != 0 {
+		t.Errorf("pushed status = %02X, want B clear", status)
+	}
+}
+
+func TestBranchDelaysIRQ(t *testing.T) {
+	// CLI; LDA #$00; then the instruction under test
+	// followed by NOPs. IRQ goes low on its last cycle.
+	run := func(inst ...byte) uint16 {
+		program := append([]byte{0x58, 0xA9, 0x00}, inst...)
+		c := interruptConsole(t, append(program, 0xEA, 0xEA)...)
+		c.cpu.Step()
+		c.cpu.Step()
+		last := c.cpu.cycles + uint64(len(inst))
+		tick := c.cpu.tick
+		c.cpu.tick = func() {
+			tick()
+			if c.cpu.ticked == last {
+				c.cpu.assertIRQ(irqMapper)
+			}
+		}
+		c.cpu.Step()
+		c.cpu.Step()
+		return c.cpu.pc
+	}
+	// LDA $00 takes 3 cycles and sees the IRQ in time
+	if pc := run(0xA5, 0x00); pc != 0x8010 {
+		t.Errorf("LDA $00: pc = %04X, want IRQ handler", pc)
+	}
+	// a taken branch that doesn't cross a page polls a
+	// cycle earlier, so the IRQ waits an instruction
+	if pc := run(0xF0, 0x00); pc != 0x8006 {
+		t.Errorf("BEQ: pc = %04X, want 8006", pc)
+	}
+}
+
+func BenchmarkStep(b *testing.B) {
+	file, err := os.Open("./nestest.nes")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	cart, _, err := readFile(file)
+	if err != nil {
+		b.Fatal(err)
+	}
+	cpu := newCPU(cart, newPPU(cart))
+	cpu.reset()
+	b.ResetTimer()
+	start := time.Now()
+	// nestest runs about 9000 instructions in automation
+	// mode so restart it every 8000
+	for i := 0; i < b.N; i++ {
+		if i%8000 == 0 {
+			cpu.reset()
+			cpu.pc = 0xC000
+		}
+		cpu.Step()
+	}
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "instructions/s")
+}
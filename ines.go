@@ -2,6 +2,7 @@ package nes
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"io"
 
 	"github.com/pkg/errors"
@@ -14,43 +15,292 @@ type iNESHeader struct {
 	NumCHR      byte
 	Flags6      byte
 	Flags7      byte
-	NumRAM      byte
-	Unused      [7]byte
+	// in iNES 1.0 Flags8 is the PRG RAM size in 8k units
+	// and Flags9-15 are mostly unused. NES 2.0 uses them
+	// for extended sizes, timing and the console type.
+	Flags8  byte
+	Flags9  byte
+	Flags10 byte
+	Flags11 byte
+	Flags12 byte
+	Flags13 byte
+	Flags14 byte
+	Flags15 byte
 }
 
 // Every .nes file starts with ASCII NES followed by $1A
 const magicNumber = 0x1a53454e
 
-func readFile(r io.Reader) (cartridge, error) {
+// Flags6 bits
+const (
+	flag6Mirror     = 1 << iota // 0 horizontal, 1 vertical
+	flag6Battery                // battery backed PRG RAM at $6000-$7FFF
+	flag6Trainer                // 512 byte trainer at $7000-$71FF
+	flag6FourScreen             // ignore mirroring and provide four screen VRAM
+)
+
+// the trainer sits between the header and PRG ROM
+const trainerSize = 512
+
+// the largest PRG or CHR ROM accepted, so a corrupt
+// header can't make readFile allocate gigabytes
+const maxROMSize = 64 << 20
+
+// Mirroring is how the cartridge arranges the nametables
+type Mirroring byte
+
+const (
+	MirrorHorizontal Mirroring = mirrorHorizontal
+	MirrorVertical   Mirroring = mirrorVertical
+	MirrorFourScreen Mirroring = mirrorFourScreen
+)
+
+func (m Mirroring) String() string {
+	switch m {
+	case MirrorHorizontal:
+		return "horizontal"
+	case MirrorVertical:
+		return "vertical"
+	case MirrorFourScreen:
+		return "four screen"
+	}
+	return "unknown"
+}
+
+// Region is the CPU/PPU timing the game was made for
+type Region byte
+
+const (
+	RegionNTSC Region = iota
+	RegionPAL
+	// the game runs on either NTSC or PAL consoles
+	RegionMulti
+	RegionDendy
+)
+
+func (r Region) String() string {
+	switch r {
+	case RegionNTSC:
+		return "NTSC"
+	case RegionPAL:
+		return "PAL"
+	case RegionMulti:
+		return "multi-region"
+	case RegionDendy:
+		return "Dendy"
+	}
+	return "unknown"
+}
+
+// ConsoleType is the kind of system the game runs on
+type ConsoleType byte
+
+const (
+	ConsoleNES ConsoleType = iota
+	ConsoleVsSystem
+	ConsolePlaychoice10
+	// the type is given by the NES 2.0 extended console type
+	ConsoleExtended
+)
+
+// CartridgeInfo describes a ROM as given by its iNES or
+// NES 2.0 header. All sizes are in bytes.
+type CartridgeInfo struct {
+	// NES2 is true if the header is in the NES 2.0 format.
+	// Otherwise it is an iNES 1.0 header and the fields
+	// only available in NES 2.0 are inferred.
+	NES2 bool
+
+	Mapper    int
+	Submapper int
+
+	PRGROMSize int
+	CHRROMSize int
+	// volatile and battery backed (non-volatile) RAM
+	PRGRAMSize   int
+	PRGNVRAMSize int
+	CHRRAMSize   int
+	CHRNVRAMSize int
+
+	Mirroring Mirroring
+	Battery   bool
+	Trainer   bool
+
+	Region              Region
+	ConsoleType         ConsoleType
+	ExtendedConsoleType byte
+
+	// CRC32 is the checksum of the PRG and CHR ROM, which
+	// game databases are keyed by. ReadCartridgeInfo only
+	// reads the header and leaves it zero.
+	CRC32 uint32
+}
+
+// ReadCartridgeInfo reads the header of an iNES or NES 2.0 file
+func ReadCartridgeInfo(r io.Reader) (CartridgeInfo, error) {
 	header := iNESHeader{}
 	err := binary.Read(r, binary.LittleEndian, &header)
 	if err != nil {
-		return nil, errors.Wrap(err, "read")
+		return CartridgeInfo{}, errors.Wrap(err, "read")
+	}
+	info, err := header.info()
+	if err != nil {
+		return CartridgeInfo{}, err
 	}
+	return *info, nil
+}
+
+func (h *iNESHeader) nes2() bool {
+	return h.Flags7&0x0C == 0x08
+}
 
-	if header.MagicNumber != magicNumber {
+func (h *iNESHeader) info() (*CartridgeInfo, error) {
+	if h.MagicNumber != magicNumber {
 		return nil, errors.New("Invalid nes file")
 	}
 
-	prg := make([]byte, int(header.NumPRG)*0x4000)
+	info := &CartridgeInfo{
+		NES2:        h.nes2(),
+		Mapper:      int(h.Flags6>>4) | int(h.Flags7&0xF0),
+		Mirroring:   Mirroring(h.Flags6 & flag6Mirror),
+		Battery:     isAnySet(h.Flags6, flag6Battery),
+		Trainer:     isAnySet(h.Flags6, flag6Trainer),
+		ConsoleType: ConsoleType(h.Flags7 & 3),
+	}
+	if isAnySet(h.Flags6, flag6FourScreen) {
+		info.Mirroring = MirrorFourScreen
+	}
+
+	if info.NES2 {
+		info.Mapper |= int(h.Flags8&0x0F) << 8
+		info.Submapper = int(h.Flags8 >> 4)
+		info.PRGROMSize = nes2ROMSize(h.NumPRG, h.Flags9&0x0F, 0x4000)
+		info.CHRROMSize = nes2ROMSize(h.NumCHR, h.Flags9>>4, 0x2000)
+		info.PRGRAMSize = nes2RAMSize(h.Flags10 & 0x0F)
+		info.PRGNVRAMSize = nes2RAMSize(h.Flags10 >> 4)
+		info.CHRRAMSize = nes2RAMSize(h.Flags11 & 0x0F)
+		info.CHRNVRAMSize = nes2RAMSize(h.Flags11 >> 4)
+		info.Region = Region(h.Flags12 & 3)
+		if info.ConsoleType == ConsoleExtended {
+			info.ExtendedConsoleType = h.Flags13 & 0x0F
+		}
+	} else {
+		// Old dumping tools wrote their name over bytes 7-15.
+		// If the tail of the header isn't blank ignore them.
+		ram := int(h.Flags8) * 0x2000
+		if h.Flags12 != 0 || h.Flags13 != 0 || h.Flags14 != 0 || h.Flags15 != 0 {
+			info.Mapper &= 0x0F
+			info.ConsoleType = ConsoleNES
+			ram = 0
+		} else if isAnySet(h.Flags9, 1) {
+			info.Region = RegionPAL
+		}
+		info.PRGROMSize = int(h.NumPRG) * 0x4000
+		info.CHRROMSize = int(h.NumCHR) * 0x2000
+		if info.CHRROMSize == 0 {
+			info.CHRRAMSize = 0x2000
+		}
+		// iNES 1.0 rarely specifies PRG RAM so boards
+		// that normally have it get 8k
+		if ram == 0 && (info.Battery || info.Mapper == 1 || info.Mapper == 4) {
+			ram = 0x2000
+		}
+		if info.Battery {
+			info.PRGNVRAMSize = ram
+		} else {
+			info.PRGRAMSize = ram
+		}
+	}
+
+	if info.PRGROMSize == 0 {
+		return nil, errors.New("no PRG ROM")
+	}
+	if info.PRGROMSize > maxROMSize || info.CHRROMSize > maxROMSize {
+		return nil, errors.New("ROM too large")
+	}
+	if info.PRGROMSize%0x2000 != 0 {
+		return nil, errors.Errorf("unsupported PRG ROM size %d", info.PRGROMSize)
+	}
+	if info.CHRROMSize%0x400 != 0 {
+		return nil, errors.Errorf("unsupported CHR ROM size %d", info.CHRROMSize)
+	}
+	return info, nil
+}
+
+// NES 2.0 ROM sizes are either a 12 bit count of units or,
+// when the high nibble is $F, an exponent and multiplier
+// of the form 2^E * (MM*2+1) packed into the low byte.
+func nes2ROMSize(lsb, msb byte, unit int) int {
+	if msb == 0x0F {
+		exponent := lsb >> 2
+		multiplier := int(lsb&3)*2 + 1
+		if exponent > 30 {
+			return -1
+		}
+		return (1 << exponent) * multiplier
+	}
+	return (int(msb)<<8 | int(lsb)) * unit
+}
+
+// NES 2.0 RAM sizes are stored as a shift count
+func nes2RAMSize(shift byte) int {
+	if shift == 0 {
+		return 0
+	}
+	return 64 << shift
+}
+
+func readFile(r io.Reader) (cartridge, *CartridgeInfo, error) {
+	header := iNESHeader{}
+	err := binary.Read(r, binary.LittleEndian, &header)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read")
+	}
+
+	info, err := header.info()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var trainer []byte
+	if info.Trainer {
+		trainer = make([]byte, trainerSize)
+		_, err = io.ReadFull(r, trainer)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "trainer")
+		}
+	}
+
+	prg := make([]byte, info.PRGROMSize)
 	_, err = io.ReadFull(r, prg)
 	if err != nil {
-		return nil, errors.Wrap(err, "PRG")
+		return nil, nil, errors.Wrap(err, "PRG")
 	}
 
-	chr := make([]byte, int(header.NumCHR)*0x2000)
+	chr := make([]byte, info.CHRROMSize)
 	_, err = io.ReadFull(r, chr)
 	if err != nil {
-		return nil, errors.Wrap(err, "CHR")
+		return nil, nil, errors.Wrap(err, "CHR")
 	}
 
+	info.CRC32 = crc32.Update(crc32.ChecksumIEEE(prg), crc32.IEEETable, chr)
+
 	// min of 8kB of chr
-	if header.NumCHR == 0 {
-		chr = make([]byte, 0x2000)
+	if info.CHRROMSize == 0 {
+		size := info.CHRRAMSize + info.CHRNVRAMSize
+		if size < 0x2000 {
+			size = 0x2000
+		}
+		chr = make([]byte, size)
 	}
 
-	mirror := header.Flags6 & 1
-	mapper := (header.Flags6 >> 4) | (header.Flags7 & 0xF0)
-
-	return newCart(mapper, mirror, prg, chr), nil
+	cart, err := newCart(info, prg, chr)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the trainer is loaded into PRG RAM at $7000
+	if trainer != nil {
+		copy(cart.prgRAM()[0x1000:], trainer)
+	}
+	return cart, info, nil
 }
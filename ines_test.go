@@ -0,0 +1,110 @@
+package nes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadCartridgeInfo(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   CartridgeInfo
+	}{
+		{
+			name:   "iNES",
+			header: []byte{'N', 'E', 'S', 0x1A, 2, 0, 0x13, 0x00, 0, 0, 0, 0, 0, 0, 0, 0},
+			want: CartridgeInfo{
+				Mapper:       1,
+				PRGROMSize:   0x8000,
+				CHRRAMSize:   0x2000,
+				PRGNVRAMSize: 0x2000,
+				Mirroring:    MirrorVertical,
+				Battery:      true,
+			},
+		},
+		{
+			name:   "DiskDude!",
+			header: []byte{'N', 'E', 'S', 0x1A, 8, 16, 0x40, 'D', 'i', 's', 'k', 'D', 'u', 'd', 'e', '!'},
+			want: CartridgeInfo{
+				Mapper:     4,
+				PRGROMSize: 0x20000,
+				CHRROMSize: 0x20000,
+				PRGRAMSize: 0x2000,
+			},
+		},
+		{
+			name:   "NES 2.0",
+			header: []byte{'N', 'E', 'S', 0x1A, 0x02, 0x00, 0x52, 0x18, 0x31, 0x01, 0x70, 0x07, 0x01, 0, 0, 0},
+			want: CartridgeInfo{
+				NES2:         true,
+				Mapper:       0x115,
+				Submapper:    3,
+				PRGROMSize:   0x102 * 0x4000,
+				PRGNVRAMSize: 0x2000,
+				CHRRAMSize:   0x2000,
+				Battery:      true,
+				Region:       RegionPAL,
+			},
+		},
+		{
+			name:   "NES 2.0 exponent size",
+			header: []byte{'N', 'E', 'S', 0x1A, 0x3D, 0x00, 0x00, 0x08, 0x00, 0x0F, 0, 0, 0x03, 0, 0, 0},
+			want: CartridgeInfo{
+				NES2:       true,
+				PRGROMSize: 0x8000 * 3,
+				Region:     RegionDendy,
+			},
+		},
+	}
+	for _, test := range tests {
+		info, err := ReadCartridgeInfo(bytes.NewReader(test.header))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if info != test.want {
+			t.Fatalf("%s: info = %+v, want %+v", test.name, info, test.want)
+		}
+	}
+}
+
+func TestBadROMSizes(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		// enough data for the valid part of the ROM
+		size int
+	}{
+		// NES 2.0 exponent sizes
+		{"UNROM 8k PRG", []byte{'N', 'E', 'S', 0x1A, 0x34, 0x01, 0x20, 0x08, 0, 0x0F, 0, 0, 0, 0, 0, 0}, 0x8000},
+		{"MMC1 8k PRG", []byte{'N', 'E', 'S', 0x1A, 0x34, 0x01, 0x10, 0x08, 0, 0x0F, 0, 0, 0, 0, 0, 0}, 0x8000},
+		{"NROM 1k CHR", []byte{'N', 'E', 'S', 0x1A, 0x01, 0x28, 0x00, 0x08, 0, 0xF0, 0, 0, 0, 0, 0, 0}, 0x8000},
+		{"7.5GB PRG", []byte{'N', 'E', 'S', 0x1A, 0x7B, 0x01, 0x00, 0x08, 0, 0x0F, 0, 0, 0, 0, 0, 0}, 0x8000},
+		// more banks than the bank registers select
+		{"UNROM 257 PRG banks", []byte{'N', 'E', 'S', 0x1A, 0x01, 0x01, 0x20, 0x08, 0, 0x01, 0, 0, 0, 0, 0, 0}, 257*0x4000 + 0x2000},
+		{"CNROM 8 CHR banks", []byte{'N', 'E', 'S', 0x1A, 0x01, 0x08, 0x30, 0x00, 0, 0, 0, 0, 0, 0, 0, 0}, 0x4000 + 8*0x2000},
+	}
+	for _, test := range tests {
+		rom := append(test.header, make([]byte, test.size)...)
+		_, err := NewConsole(bytes.NewReader(rom))
+		if err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func TestLargeUNROM(t *testing.T) {
+	// 4MB is 256 banks, all the bank register can select
+	header := []byte{'N', 'E', 'S', 0x1A, 0x00, 0x01, 0x20, 0x08, 0, 0x01, 0, 0, 0, 0, 0, 0}
+	prg := make([]byte, 256*0x4000)
+	prg[255*0x4000] = 0x12
+	rom := append(append(header, prg...), make([]byte, 0x2000)...)
+	c, err := NewConsole(bytes.NewReader(rom))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cpu.writeByte(0x8000, 0xFF)
+	if value := c.cpu.readByte(0x8000); value != 0x12 {
+		t.Fatalf("bank 255 $8000 = %02X, want 12", value)
+	}
+}
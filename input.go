@@ -0,0 +1,33 @@
+package nes
+
+// The two controller ports on the front of the console
+const (
+	Port1 = iota
+	Port2
+)
+
+// Players for SetJoypad
+const (
+	Player1 = iota
+	Player2
+	// players 3 and 4 need a multitap, see SetMultitap
+	Player3
+	Player4
+)
+
+// InputDevice is a peripheral that can be plugged into
+// one of the controller ports.
+type InputDevice interface {
+	// Read is called when the CPU reads the device's port,
+	// $4016 for port 1 and $4017 for port 2. Only the low
+	// 5 bits are driven by the device, the rest are open bus.
+	Read() byte
+	// Write is called with every value written to $4016.
+	// Bit 0 is the strobe shared by both ports.
+	Write(value byte)
+}
+
+// the upper 3 bits of the controller ports aren't driven
+// and hold the last value on the data bus, usually the
+// high byte of the port's address
+const portMask = 0x1F
@@ -29,8 +29,20 @@ type joypad struct {
 	buttonState byte
 }
 
+func (j *joypad) setButton(button byte, pressed bool) {
+	if pressed {
+		j.buttonState = setBits(j.buttonState, button)
+	} else {
+		j.buttonState = resetBits(j.buttonState, button)
+	}
+}
+
+func (j *joypad) syncState(s *stateStream) {
+	s.sync(&j.strobe, &j.buttonIndex, &j.buttonState)
+}
+
 // Read the state of a single button
-func (j *joypad) read() byte {
+func (j *joypad) Read() byte {
 	if j.buttonIndex > 7 {
 		return 1
 	}
@@ -38,14 +50,19 @@ func (j *joypad) read() byte {
 	if j.strobe {
 		return j.buttonState & 1
 	}
-	value := j.buttonState & (1 << j.buttonIndex) >> j.buttonIndex
+	value := j.bit(j.buttonIndex)
 	j.buttonIndex++
 	return value
 }
 
+// bit returns the state of the button at index
+func (j *joypad) bit(index byte) byte {
+	return j.buttonState & (1 << index) >> index
+}
+
 // writing 1 to the joypad will enable strobe
 // mode and reset the buttonIndex = 0
-func (j *joypad) write(value byte) {
+func (j *joypad) Write(value byte) {
 	j.strobe = value&1 == 1
 	if j.strobe {
 		j.buttonIndex = 0
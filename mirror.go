@@ -5,6 +5,9 @@ const (
 	mirrorVertical
 	mirrorSingle0
 	mirrorSingle1
+	// the cartridge provides an extra 2k of
+	// VRAM so each nametable is unique
+	mirrorFourScreen
 )
 
 func mirror(mode byte, address uint16) uint16 {
@@ -13,7 +16,6 @@ func mirror(mode byte, address uint16) uint16 {
 	// which of the 4 name tables
 	table := address / 0x400
 
-	// todo implement more mirroring modes
 	switch mode {
 	case mirrorHorizontal:
 		table /= 2
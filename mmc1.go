@@ -1,14 +1,16 @@
 package nes
 
 import (
-	"log"
+	"github.com/pkg/errors"
 )
 
 type mmc1 struct {
 	mirrorMode byte
 	prg        []byte
 	chr        []byte
-	sram       [0x2000]byte
+	sram       []byte
+	// boards without CHR ROM have RAM instead
+	chrRAM bool
 
 	// registers are written to by
 	// first write to the shift register
@@ -23,19 +25,42 @@ type mmc1 struct {
 	// figure out our bank offsets
 	prgOffsets [2]int
 	chrOffsets [2]int
+
+	// the shift register ignores a write on the cycle
+	// after another one, which is how the two writes of
+	// a read-modify-write instruction arrive
+	cpu       *cpu
+	lastWrite uint64
+
+	err error
 }
 
-func newMMC1(mirror byte, prg, chr []byte) *mmc1 {
+func newMMC1(mirror byte, prg, chr, sram []byte) *mmc1 {
 	m := &mmc1{
 		mirrorMode: mirror,
 		prg:        prg,
 		chr:        chr,
+		sram:       sram,
 		shift:      0x10,
 	}
 	m.prgOffsets[1] = len(prg) - 0x4000
 	return m
 }
 
+func (n *mmc1) connectCPU(c *cpu) {
+	n.cpu = c
+}
+
+func (n *mmc1) syncState(s *stateStream) {
+	s.sync(n.chr, n.sram, &n.mirrorMode)
+	s.sync(&n.shift, &n.ctrl, &n.chrBank0, &n.chrBank1, &n.prgBank)
+	s.sync(n.prgOffsets[:], n.chrOffsets[:], &n.lastWrite)
+}
+
+func (n *mmc1) prgRAM() []byte {
+	return n.sram
+}
+
 func (n *mmc1) readByte(address uint16) byte {
 	switch {
 	case address < 0x2000:
@@ -47,31 +72,48 @@ func (n *mmc1) readByte(address uint16) byte {
 		bankOffset := address % 0x4000
 		return n.prg[n.prgOffsets[bank]+int(bankOffset)]
 	case address >= 0x6000:
-		index := int(address - 0x6000)
+		if len(n.sram) == 0 {
+			return 0
+		}
+		index := int(address-0x6000) % len(n.sram)
 		return n.sram[index]
 	default:
-		log.Fatalf("mmc1 invalid read address %04X", address)
+		n.err = errors.Errorf("mmc1 invalid read address %04X", address)
 	}
 	return 0
 }
 
+func (n *mmc1) mapped(address uint16) bool {
+	return address >= 0x8000 || address >= 0x6000 && len(n.sram) > 0
+}
+
 func (n *mmc1) write(address uint16, value byte) {
 	switch {
 	case address < 0x2000:
 		bank := address / 0x1000
 		bankOffset := address % 0x1000
-		n.chr[n.chrOffsets[bank]+int(bankOffset)] = value
+		if n.chrRAM {
+			n.chr[n.chrOffsets[bank]+int(bankOffset)] = value
+		}
 	case address >= 0x8000:
 		n.loadRegister(address, value)
 	case address >= 0x6000:
+		if len(n.sram) == 0 {
+			return
+		}
 		index := int(address-0x6000) % len(n.sram)
 		n.sram[index] = value
 	default:
-		log.Fatalf("mmc1 invalid write address %04X", address)
+		n.err = errors.Errorf("mmc1 invalid write address %04X", address)
 	}
 }
 
 func (n *mmc1) loadRegister(address uint16, value byte) {
+	consecutive := n.cpu.cycles == n.lastWrite+1
+	n.lastWrite = n.cpu.cycles
+	if consecutive {
+		return
+	}
 	// if bit 7 is hi, reset the shift register
 	if value&0x80 == 0x80 {
 		n.shift = 0x10
@@ -100,10 +142,8 @@ func (n *mmc1) writeRegister(address uint16) {
 		n.chrBank0 = n.shift
 	case address < 0xE000:
 		n.chrBank1 = n.shift
-	case address >= 0xE000:
-		n.prgBank = n.shift & 0x0F
 	default:
-		log.Fatalf("invalid register address %04X", address)
+		n.prgBank = n.shift & 0x0F
 	}
 }
 
@@ -120,7 +160,8 @@ func (n *mmc1) evaluateRegisters() {
 		// n.prgOffsets
 		bank := int(n.prgBank&0x0E) % numPrg
 		n.prgOffsets[0] = bank * 0x4000
-		n.prgOffsets[1] = (bank + 1) * 0x4000
+		// a 16k board mirrors its only bank
+		n.prgOffsets[1] = ((bank + 1) % numPrg) * 0x4000
 	case 2:
 		// fix first bank at $8000 and switch 16 KB bank at $C000
 		bank := int(n.prgBank) % numPrg
@@ -158,3 +199,11 @@ func (n *mmc1) evaluateRegisters() {
 func (n *mmc1) mirror(address uint16) uint16 {
 	return mirror(n.mirrorMode, address)
 }
+
+func (n *mmc1) fault() error {
+	return n.err
+}
+
+func (n *mmc1) clearFault() {
+	n.err = nil
+}
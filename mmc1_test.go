@@ -0,0 +1,39 @@
+package nes
+
+import "testing"
+
+func TestMMC1ConsecutiveWrites(t *testing.T) {
+	m := newMMC1(mirrorHorizontal, make([]byte, 0x8000), make([]byte, 0x2000), nil)
+	c := &cpu{}
+	m.connectCPU(c)
+
+	// a write on the next cycle is ignored
+	c.cycles = 10
+	m.write(0x8000, 1)
+	c.cycles = 11
+	m.write(0x8000, 1)
+	if m.shift != 0x18 {
+		t.Fatalf("shift = %02X, want 18", m.shift)
+	}
+	c.cycles = 13
+	m.write(0x8000, 1)
+	if m.shift != 0x1C {
+		t.Fatalf("shift = %02X, want 1C", m.shift)
+	}
+}
+
+func TestMMC132kMode(t *testing.T) {
+	prg := make([]byte, 0x4000)
+	prg[0] = 0x12
+	m := newMMC1(mirrorHorizontal, prg, make([]byte, 0x2000), nil)
+	c := &cpu{}
+	m.connectCPU(c)
+	// control mode 0 switches 32k, which a 16k board doesn't have
+	for i := 0; i < 5; i++ {
+		c.cycles += 2
+		m.write(0x8000, 0)
+	}
+	if value := m.readByte(0xC000); value != 0x12 {
+		t.Fatalf("$C000 = %02X, want 12", value)
+	}
+}
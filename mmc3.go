@@ -0,0 +1,249 @@
+package nes
+
+import (
+	"github.com/pkg/errors"
+)
+
+type mmc3 struct {
+	mirrorMode byte
+	prg        []byte
+	chr        []byte
+	sram       []byte
+	// boards without CHR ROM have RAM instead
+	chrRAM bool
+
+	// the cpu's IRQ line is driven by the scanline counter
+	cpu *cpu
+
+	// $8000 selects which of the 8 bank registers
+	// the next write to $8001 updates, along with
+	// the PRG and CHR banking modes
+	bankSelect byte
+	registers  [8]byte
+
+	// $A001 PRG RAM protect
+	sramEnabled   bool
+	sramProtected bool
+
+	// scanline counter
+	irqLatch   byte
+	irqCounter byte
+	irqReload  bool
+	irqEnabled bool
+
+	// the counter is clocked when A12 rises after
+	// having been low for a few CPU cycles
+	a12High     bool
+	a12LowClock uint64
+
+	// after writing to the registers
+	// figure out our bank offsets.
+	// PRG is in 8k banks and CHR in 1k banks
+	prgOffsets [4]int
+	chrOffsets [8]int
+
+	err error
+}
+
+func newMMC3(mirror byte, prg, chr, sram []byte) *mmc3 {
+	m := &mmc3{
+		mirrorMode:  mirror,
+		prg:         prg,
+		chr:         chr,
+		sram:        sram,
+		sramEnabled: true,
+	}
+	m.evaluateRegisters()
+	return m
+}
+
+func (m *mmc3) connectCPU(c *cpu) {
+	m.cpu = c
+}
+
+func (m *mmc3) syncState(s *stateStream) {
+	s.sync(m.chr, m.sram, &m.mirrorMode)
+	s.sync(&m.bankSelect, &m.registers, &m.sramEnabled, &m.sramProtected)
+	s.sync(&m.irqLatch, &m.irqCounter, &m.irqReload, &m.irqEnabled, &m.a12High, &m.a12LowClock)
+	s.sync(m.prgOffsets[:], m.chrOffsets[:])
+}
+
+func (m *mmc3) prgRAM() []byte {
+	return m.sram
+}
+
+func (m *mmc3) readByte(address uint16) byte {
+	switch {
+	case address < 0x2000:
+		bank := address / 0x0400
+		bankOffset := address % 0x0400
+		return m.chr[m.chrOffsets[bank]+int(bankOffset)]
+	case address >= 0x8000:
+		bank := (address - 0x8000) / 0x2000
+		bankOffset := address % 0x2000
+		return m.prg[m.prgOffsets[bank]+int(bankOffset)]
+	case address >= 0x6000:
+		if !m.sramEnabled || len(m.sram) == 0 {
+			return 0
+		}
+		return m.sram[int(address-0x6000)%len(m.sram)]
+	default:
+		m.err = errors.Errorf("mmc3 invalid read address %04X", address)
+	}
+	return 0
+}
+
+func (m *mmc3) mapped(address uint16) bool {
+	return address >= 0x8000 || address >= 0x6000 && m.sramEnabled && len(m.sram) > 0
+}
+
+func (m *mmc3) write(address uint16, value byte) {
+	switch {
+	case address < 0x2000:
+		bank := address / 0x0400
+		bankOffset := address % 0x0400
+		if m.chrRAM {
+			m.chr[m.chrOffsets[bank]+int(bankOffset)] = value
+		}
+	case address >= 0x8000:
+		m.writeRegister(address, value)
+	case address >= 0x6000:
+		if m.sramEnabled && !m.sramProtected && len(m.sram) > 0 {
+			m.sram[int(address-0x6000)%len(m.sram)] = value
+		}
+	default:
+		m.err = errors.Errorf("mmc3 invalid write address %04X", address)
+	}
+}
+
+// the registers are mirrored across each 8k range
+// with even and odd addresses selecting between pairs
+func (m *mmc3) writeRegister(address uint16, value byte) {
+	even := address%2 == 0
+	switch {
+	case address < 0xA000 && even:
+		m.bankSelect = value
+		m.evaluateRegisters()
+	case address < 0xA000:
+		m.registers[m.bankSelect&7] = value
+		m.evaluateRegisters()
+	case address < 0xC000 && even:
+		// four screen boards ignore mirroring
+		if m.mirrorMode == mirrorFourScreen {
+			return
+		}
+		if value&1 == 0 {
+			m.mirrorMode = mirrorVertical
+		} else {
+			m.mirrorMode = mirrorHorizontal
+		}
+	case address < 0xC000:
+		m.sramEnabled = value&0x80 == 0x80
+		m.sramProtected = value&0x40 == 0x40
+	case address < 0xE000 && even:
+		m.irqLatch = value
+	case address < 0xE000:
+		// the counter is reloaded on the next clock
+		m.irqCounter = 0
+		m.irqReload = true
+	case even:
+		// disabling also acknowledges a pending interrupt
+		m.irqEnabled = false
+		m.cpu.releaseIRQ(irqMapper)
+	default:
+		m.irqEnabled = true
+	}
+}
+
+func (m *mmc3) evaluateRegisters() {
+	prgMode := (m.bankSelect >> 6) & 1
+	chrInversion := (m.bankSelect >> 7) & 1
+	numPrg := len(m.prg) / 0x2000
+	numChr := len(m.chr) / 0x0400
+
+	prgBank := func(bank int) int {
+		return (bank % numPrg) * 0x2000
+	}
+	secondLast := prgBank(numPrg - 2)
+	if prgMode == 0 {
+		// $8000 swappable, $C000 fixed to the second last bank
+		m.prgOffsets[0] = prgBank(int(m.registers[6]))
+		m.prgOffsets[2] = secondLast
+	} else {
+		// $C000 swappable, $8000 fixed to the second last bank
+		m.prgOffsets[0] = secondLast
+		m.prgOffsets[2] = prgBank(int(m.registers[6]))
+	}
+	m.prgOffsets[1] = prgBank(int(m.registers[7]))
+	m.prgOffsets[3] = prgBank(numPrg - 1)
+
+	chrBank := func(bank byte) int {
+		return (int(bank) % numChr) * 0x0400
+	}
+	// two 2k banks and four 1k banks. Inversion swaps
+	// which pattern table gets the 2k banks.
+	var offsets [8]int
+	offsets[0] = chrBank(m.registers[0] & 0xFE)
+	offsets[1] = chrBank(m.registers[0] | 1)
+	offsets[2] = chrBank(m.registers[1] & 0xFE)
+	offsets[3] = chrBank(m.registers[1] | 1)
+	offsets[4] = chrBank(m.registers[2])
+	offsets[5] = chrBank(m.registers[3])
+	offsets[6] = chrBank(m.registers[4])
+	offsets[7] = chrBank(m.registers[5])
+	for i := range offsets {
+		if chrInversion == 1 {
+			m.chrOffsets[i^4] = offsets[i]
+		} else {
+			m.chrOffsets[i] = offsets[i]
+		}
+	}
+}
+
+// how long A12 must stay low for its next rise to count, in
+// PPU cycles. This filters out the rises between each of
+// the sprite fetches.
+const mmc3A12Filter = 10
+
+func (m *mmc3) ppuAddress(address uint16, clock uint64) {
+	if address&0x1000 == 0 {
+		if m.a12High {
+			m.a12High = false
+			m.a12LowClock = clock
+		}
+		return
+	}
+	if !m.a12High {
+		m.a12High = true
+		if clock-m.a12LowClock >= mmc3A12Filter {
+			m.clockScanline()
+		}
+	}
+}
+
+// clockScanline is called once per rendered scanline when
+// A12 rises as the PPU starts fetching sprite patterns.
+// When the counter reaches zero an IRQ is raised.
+func (m *mmc3) clockScanline() {
+	if m.irqCounter == 0 || m.irqReload {
+		m.irqCounter = m.irqLatch
+		m.irqReload = false
+	} else {
+		m.irqCounter--
+	}
+	if m.irqCounter == 0 && m.irqEnabled {
+		m.cpu.assertIRQ(irqMapper)
+	}
+}
+
+func (m *mmc3) mirror(address uint16) uint16 {
+	return mirror(m.mirrorMode, address)
+}
+
+func (m *mmc3) fault() error {
+	return m.err
+}
+
+func (m *mmc3) clearFault() {
+	m.err = nil
+}
@@ -0,0 +1,157 @@
+package nes
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestMMC3ScanlineIRQ(t *testing.T) {
+	m := newMMC3(mirrorHorizontal, make([]byte, 0x8000), make([]byte, 0x2000), nil)
+	c := &cpu{}
+	m.connectCPU(c)
+
+	// latch 2, reload and enable
+	m.write(0xC000, 2)
+	m.write(0xC001, 0)
+	m.write(0xE001, 0)
+
+	for i := 0; i < 2; i++ {
+		m.clockScanline()
+		if c.irqLine != 0 {
+			t.Fatalf("irq asserted after %d scanlines", i+1)
+		}
+	}
+	m.clockScanline()
+	if c.irqLine != irqMapper {
+		t.Fatalf("irqLine = %02X, want %02X", c.irqLine, irqMapper)
+	}
+
+	// disabling acknowledges
+	m.write(0xE000, 0)
+	if c.irqLine != 0 {
+		t.Fatal("irq not acknowledged")
+	}
+}
+
+func TestMMC3Banks(t *testing.T) {
+	prg := make([]byte, 0x10000)
+	for i := range prg {
+		prg[i] = byte(i / 0x2000)
+	}
+	chr := make([]byte, 0x4000)
+	for i := range chr {
+		chr[i] = byte(i / 0x0400)
+	}
+	m := newMMC3(mirrorHorizontal, prg, chr, nil)
+
+	// R6 = 3, R7 = 4, R0 = 5 (2k so 4 and 5), R2 = 9
+	for _, w := range [][2]byte{{6, 3}, {7, 4}, {0, 5}, {2, 9}} {
+		m.write(0x8000, w[0])
+		m.write(0x8001, w[1])
+	}
+	expectPRG := func(want [4]byte) {
+		for i, bank := range want {
+			if got := m.readByte(0x8000 + uint16(i)*0x2000); got != bank {
+				t.Fatalf("prg bank at %04X = %d, want %d", 0x8000+i*0x2000, got, bank)
+			}
+		}
+	}
+	expectPRG([4]byte{3, 4, 6, 7})
+	if got := m.readByte(0x0000); got != 4 {
+		t.Fatalf("chr bank at 0000 = %d, want 4", got)
+	}
+	if got := m.readByte(0x1000); got != 9 {
+		t.Fatalf("chr bank at 1000 = %d, want 9", got)
+	}
+
+	// switch PRG mode and invert CHR
+	m.write(0x8000, 0xC0)
+	expectPRG([4]byte{6, 4, 3, 7})
+	if got := m.readByte(0x1000); got != 4 {
+		t.Fatalf("inverted chr bank at 1000 = %d, want 4", got)
+	}
+	if got := m.readByte(0x0000); got != 9 {
+		t.Fatalf("inverted chr bank at 0000 = %d, want 9", got)
+	}
+}
+
+func TestMMC3A12(t *testing.T) {
+	m := newMMC3(mirrorHorizontal, make([]byte, 0x8000), make([]byte, 0x2000), nil)
+	m.connectCPU(&cpu{})
+	p := newPPU(m)
+	image := image.NewRGBA(image.Rect(0, 0, 256, 240))
+
+	m.write(0xC000, 255)
+	m.write(0xC001, 0)
+
+	// background at $0000 and sprites at $1000 clock
+	// the counter once per line including pre-render
+	p.ctrl = ctrlS
+	p.mask = maskBG | maskSP
+	for i := 0; i < 341*262; i++ {
+		p.step(image)
+	}
+	if m.irqCounter != 255-240 {
+		t.Fatalf("irqCounter = %d, want %d", m.irqCounter, 255-240)
+	}
+}
+
+func TestMMC3ClockedByPPUADDR(t *testing.T) {
+	// set A12 then clear it through $2006, as the mmc3 test
+	// ROMs do with rendering off
+	var program []byte
+	for i := 0; i < 8; i++ {
+		program = append(program,
+			0x8E, 0x06, 0x20, 0x8C, 0x06, 0x20, // v = $1000
+			0x8C, 0x06, 0x20, 0x8C, 0x06, 0x20, // v = $0000
+		)
+	}
+	c, err := NewConsole(bytes.NewReader(testROM(4, program...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cpu.x = 0x10
+	clock := func() {
+		for i := 0; i < 4; i++ {
+			c.cpu.Step()
+		}
+	}
+
+	// latch 2: reload, 1, then 0 raises the IRQ
+	c.cpu.writeByte(0xC000, 2)
+	c.cpu.writeByte(0xC001, 0)
+	c.cpu.writeByte(0xE001, 0)
+	for i := 0; i < 2; i++ {
+		clock()
+		if c.cpu.irqLine != 0 {
+			t.Fatalf("IRQ after %d clocks", i+1)
+		}
+	}
+	clock()
+	if c.cpu.irqLine != irqMapper {
+		t.Fatal("expected an IRQ after 3 clocks")
+	}
+
+	// a latch of 0 raises the IRQ on every clock
+	c.cpu.writeByte(0xC000, 0)
+	for i := 0; i < 2; i++ {
+		c.cpu.writeByte(0xE000, 0)
+		c.cpu.writeByte(0xE001, 0)
+		clock()
+		if c.cpu.irqLine != irqMapper {
+			t.Fatalf("no IRQ on clock %d with latch 0", i+1)
+		}
+	}
+
+	// $C001 clears the counter so the next clock reloads it
+	c.cpu.writeByte(0xE000, 0)
+	c.cpu.writeByte(0xC000, 5)
+	c.cpu.writeByte(0xC001, 0)
+	c.cpu.writeByte(0xE001, 0)
+	clock()
+	m := c.cart.(*mmc3)
+	if m.irqCounter != 5 || c.cpu.irqLine != 0 {
+		t.Fatalf("counter = %d after reload, want 5", m.irqCounter)
+	}
+}
@@ -0,0 +1,111 @@
+package nes
+
+// Multitap is an adapter that lets four joypads share
+// the two controller ports
+type Multitap byte
+
+const (
+	// MultitapNone plugs joypads 1 and 2 straight into the ports
+	MultitapNone Multitap = iota
+	// MultitapFourScore is the NES Four Score. Each port
+	// reads 8 bits of its first joypad, 8 bits of its
+	// second and then an 8 bit signature, all on D0.
+	MultitapFourScore
+	// MultitapHori is the Famicom Hori 4 player adapter.
+	// Joypads 1 and 2 read on D0 as usual while joypads 3
+	// and 4 read on D1 followed by a signature.
+	MultitapHori
+)
+
+func (m Multitap) String() string {
+	switch m {
+	case MultitapNone:
+		return "none"
+	case MultitapFourScore:
+		return "Four Score"
+	case MultitapHori:
+		return "Hori 4 player adapter"
+	}
+	return "unknown"
+}
+
+// the signatures sent after the joypads,
+// indexed by port. Hori swaps them.
+var (
+	fourScoreSignatures = [2]byte{0x08, 0x04}
+	horiSignatures      = [2]byte{0x04, 0x08}
+)
+
+// multitap reads the four joypads through the
+// shift register logic of the standard joypad
+type multitap struct {
+	kind    Multitap
+	joypads *[4]*joypad
+
+	strobe bool
+	// how many bits each port has read
+	readIndex [2]byte
+}
+
+func (m *multitap) syncState(s *stateStream) {
+	s.sync(&m.strobe, &m.readIndex)
+}
+
+// bit returns the next bit of the 24 bit stream for port:
+// the first joypad, the second joypad, then the signature.
+// After all 24 it returns 1s like the joypad does.
+func (m *multitap) bit(port int, first, second *joypad, signatures [2]byte) byte {
+	index := m.readIndex[port]
+	if m.strobe {
+		index = 0
+	} else if index < 24 {
+		m.readIndex[port]++
+	}
+	switch {
+	case index < 8:
+		return first.bit(index)
+	case index < 16 && second != nil:
+		return second.bit(index - 8)
+	case index < 16:
+		return 0
+	case index < 24:
+		return signatures[port] >> (index - 16) & 1
+	}
+	return 1
+}
+
+func (m *multitap) write(value byte) {
+	m.strobe = value&1 == 1
+	if m.strobe {
+		m.readIndex = [2]byte{}
+	}
+	for _, j := range m.joypads {
+		j.Write(value)
+	}
+}
+
+// multitapPort is one side of the multitap
+// as seen from a controller port
+type multitapPort struct {
+	tap  *multitap
+	port int
+}
+
+func (p *multitapPort) Read() byte {
+	m := p.tap
+	if m.kind == MultitapHori {
+		// D1 carries joypad 3 or 4 and the signature, there's
+		// no second joypad on it so those 8 bits read as 0
+		value := m.joypads[p.port].Read()
+		return value | m.bit(p.port, m.joypads[p.port+2], nil, horiSignatures)<<1
+	}
+	return m.bit(p.port, m.joypads[p.port], m.joypads[p.port+2], fourScoreSignatures)
+}
+
+// Write only strobes through port 1 so
+// both ports are strobed from there
+func (p *multitapPort) Write(value byte) {
+	if p.port == Port1 {
+		p.tap.write(value)
+	}
+}
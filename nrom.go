@@ -1,11 +1,17 @@
 package nes
 
-import "log"
-
 type nROM struct {
 	mirrorMode byte
 	prg        []byte
 	chr        []byte
+	// boards without CHR ROM have RAM instead
+	chrRAM bool
+	// some boards have PRG RAM
+	sram []byte
+}
+
+func (n *nROM) prgRAM() []byte {
+	return n.sram
 }
 
 func (n *nROM) readByte(address uint16) byte {
@@ -18,16 +24,39 @@ func (n *nROM) readByte(address uint16) byte {
 	case address >= 0x8000:
 		index := int(address - 0x8000)
 		return n.prg[index%len(n.prg)]
-	default:
-		log.Fatalf("invalid address %04x\n", address)
+	case address >= 0x6000 && len(n.sram) > 0:
+		return n.sram[int(address-0x6000)%len(n.sram)]
 	}
 	return 0
 }
 
+func (n *nROM) mapped(address uint16) bool {
+	return address >= 0x8000 || address >= 0x6000 && len(n.sram) > 0
+}
+
 func (n *nROM) write(address uint16, value byte) {
-	log.Fatal("NROM doesn't support writes")
+	switch {
+	case address < 0x2000:
+		if n.chrRAM {
+			n.chr[address] = value
+		}
+	case address >= 0x8000:
+		// ROM ignores writes
+	case address >= 0x6000 && len(n.sram) > 0:
+		n.sram[int(address-0x6000)%len(n.sram)] = value
+	}
+}
+
+func (n *nROM) syncState(s *stateStream) {
+	s.sync(n.chr, n.sram)
 }
 
 func (n *nROM) mirror(address uint16) uint16 {
 	return mirror(n.mirrorMode, address)
 }
+
+func (n *nROM) fault() error {
+	return nil
+}
+
+func (n *nROM) clearFault() {}
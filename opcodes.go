@@ -0,0 +1,319 @@
+package nes
+
+import "fmt"
+
+// instruction describes how to decode and run an opcode
+type instruction struct {
+	name string
+	mode int
+	// bytes including the opcode
+	size uint16
+	// cycles taken not counting page crossings or branches.
+	// The cpu spends one cycle per bus access so this is only
+	// documentation, the tests check the two agree.
+	cycles uint64
+	// reads with indexed addressing skip the dummy read
+	// while the high byte is fixed unless the index crosses
+	// a page. Writes and read modify writes always do it.
+	pagePenalty bool
+	handler     func(c *cpu, address uint16)
+}
+
+// instructions is indexed by opcode
+var instructions = [256]instruction{
+	0x00: {"BRK", modeImplied, 1, 7, false, (*cpu).brk},
+	0x01: {"ORA", modeIndexedIndirect, 2, 6, false, (*cpu).ora},
+	0x02: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x03: {"SLO", modeIndexedIndirect, 2, 8, false, (*cpu).slo},
+	0x04: {"NOP", modeZeroPage, 2, 3, false, (*cpu).nopRead},
+	0x05: {"ORA", modeZeroPage, 2, 3, false, (*cpu).ora},
+	0x06: {"ASL", modeZeroPage, 2, 5, false, (*cpu).asl},
+	0x07: {"SLO", modeZeroPage, 2, 5, false, (*cpu).slo},
+	0x08: {"PHP", modeImplied, 1, 3, false, (*cpu).php},
+	0x09: {"ORA", modeImmediate, 2, 2, false, (*cpu).ora},
+	0x0A: {"ASL", modeAccumulator, 1, 2, false, (*cpu).asla},
+	0x0B: {"ANC", modeImmediate, 2, 2, false, (*cpu).anc},
+	0x0C: {"NOP", modeAbsolute, 3, 4, false, (*cpu).nopRead},
+	0x0D: {"ORA", modeAbsolute, 3, 4, false, (*cpu).ora},
+	0x0E: {"ASL", modeAbsolute, 3, 6, false, (*cpu).asl},
+	0x0F: {"SLO", modeAbsolute, 3, 6, false, (*cpu).slo},
+	0x10: {"BPL", modeRelative, 2, 2, false, (*cpu).bpl},
+	0x11: {"ORA", modeIndirectIndexed, 2, 5, true, (*cpu).ora},
+	0x12: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x13: {"SLO", modeIndirectIndexed, 2, 8, false, (*cpu).slo},
+	0x14: {"NOP", modeZeroPageX, 2, 4, false, (*cpu).nopRead},
+	0x15: {"ORA", modeZeroPageX, 2, 4, false, (*cpu).ora},
+	0x16: {"ASL", modeZeroPageX, 2, 6, false, (*cpu).asl},
+	0x17: {"SLO", modeZeroPageX, 2, 6, false, (*cpu).slo},
+	0x18: {"CLC", modeImplied, 1, 2, false, (*cpu).clc},
+	0x19: {"ORA", modeAbsoluteY, 3, 4, true, (*cpu).ora},
+	0x1A: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0x1B: {"SLO", modeAbsoluteY, 3, 7, false, (*cpu).slo},
+	0x1C: {"NOP", modeAbsoluteX, 3, 4, true, (*cpu).nopRead},
+	0x1D: {"ORA", modeAbsoluteX, 3, 4, true, (*cpu).ora},
+	0x1E: {"ASL", modeAbsoluteX, 3, 7, false, (*cpu).asl},
+	0x1F: {"SLO", modeAbsoluteX, 3, 7, false, (*cpu).slo},
+	0x20: {"JSR", modeAbsolute, 3, 6, false, (*cpu).jsr},
+	0x21: {"AND", modeIndexedIndirect, 2, 6, false, (*cpu).and},
+	0x22: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x23: {"RLA", modeIndexedIndirect, 2, 8, false, (*cpu).rla},
+	0x24: {"BIT", modeZeroPage, 2, 3, false, (*cpu).bit},
+	0x25: {"AND", modeZeroPage, 2, 3, false, (*cpu).and},
+	0x26: {"ROL", modeZeroPage, 2, 5, false, (*cpu).rol},
+	0x27: {"RLA", modeZeroPage, 2, 5, false, (*cpu).rla},
+	0x28: {"PLP", modeImplied, 1, 4, false, (*cpu).plp},
+	0x29: {"AND", modeImmediate, 2, 2, false, (*cpu).and},
+	0x2A: {"ROL", modeAccumulator, 1, 2, false, (*cpu).rola},
+	0x2B: {"ANC", modeImmediate, 2, 2, false, (*cpu).anc},
+	0x2C: {"BIT", modeAbsolute, 3, 4, false, (*cpu).bit},
+	0x2D: {"AND", modeAbsolute, 3, 4, false, (*cpu).and},
+	0x2E: {"ROL", modeAbsolute, 3, 6, false, (*cpu).rol},
+	0x2F: {"RLA", modeAbsolute, 3, 6, false, (*cpu).rla},
+	0x30: {"BMI", modeRelative, 2, 2, false, (*cpu).bmi},
+	0x31: {"AND", modeIndirectIndexed, 2, 5, true, (*cpu).and},
+	0x32: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x33: {"RLA", modeIndirectIndexed, 2, 8, false, (*cpu).rla},
+	0x34: {"NOP", modeZeroPageX, 2, 4, false, (*cpu).nopRead},
+	0x35: {"AND", modeZeroPageX, 2, 4, false, (*cpu).and},
+	0x36: {"ROL", modeZeroPageX, 2, 6, false, (*cpu).rol},
+	0x37: {"RLA", modeZeroPageX, 2, 6, false, (*cpu).rla},
+	0x38: {"SEC", modeImplied, 1, 2, false, (*cpu).sec},
+	0x39: {"AND", modeAbsoluteY, 3, 4, true, (*cpu).and},
+	0x3A: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0x3B: {"RLA", modeAbsoluteY, 3, 7, false, (*cpu).rla},
+	0x3C: {"NOP", modeAbsoluteX, 3, 4, true, (*cpu).nopRead},
+	0x3D: {"AND", modeAbsoluteX, 3, 4, true, (*cpu).and},
+	0x3E: {"ROL", modeAbsoluteX, 3, 7, false, (*cpu).rol},
+	0x3F: {"RLA", modeAbsoluteX, 3, 7, false, (*cpu).rla},
+	0x40: {"RTI", modeImplied, 1, 6, false, (*cpu).rti},
+	0x41: {"EOR", modeIndexedIndirect, 2, 6, false, (*cpu).eor},
+	0x42: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x43: {"SRE", modeIndexedIndirect, 2, 8, false, (*cpu).sre},
+	0x44: {"NOP", modeZeroPage, 2, 3, false, (*cpu).nopRead},
+	0x45: {"EOR", modeZeroPage, 2, 3, false, (*cpu).eor},
+	0x46: {"LSR", modeZeroPage, 2, 5, false, (*cpu).lsr},
+	0x47: {"SRE", modeZeroPage, 2, 5, false, (*cpu).sre},
+	0x48: {"PHA", modeImplied, 1, 3, false, (*cpu).pha},
+	0x49: {"EOR", modeImmediate, 2, 2, false, (*cpu).eor},
+	0x4A: {"LSR", modeAccumulator, 1, 2, false, (*cpu).lsra},
+	0x4B: {"ALR", modeImmediate, 2, 2, false, (*cpu).alr},
+	0x4C: {"JMP", modeAbsolute, 3, 3, false, (*cpu).jmp},
+	0x4D: {"EOR", modeAbsolute, 3, 4, false, (*cpu).eor},
+	0x4E: {"LSR", modeAbsolute, 3, 6, false, (*cpu).lsr},
+	0x4F: {"SRE", modeAbsolute, 3, 6, false, (*cpu).sre},
+	0x50: {"BVC", modeRelative, 2, 2, false, (*cpu).bvc},
+	0x51: {"EOR", modeIndirectIndexed, 2, 5, true, (*cpu).eor},
+	0x52: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x53: {"SRE", modeIndirectIndexed, 2, 8, false, (*cpu).sre},
+	0x54: {"NOP", modeZeroPageX, 2, 4, false, (*cpu).nopRead},
+	0x55: {"EOR", modeZeroPageX, 2, 4, false, (*cpu).eor},
+	0x56: {"LSR", modeZeroPageX, 2, 6, false, (*cpu).lsr},
+	0x57: {"SRE", modeZeroPageX, 2, 6, false, (*cpu).sre},
+	0x58: {"CLI", modeImplied, 1, 2, false, (*cpu).cli},
+	0x59: {"EOR", modeAbsoluteY, 3, 4, true, (*cpu).eor},
+	0x5A: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0x5B: {"SRE", modeAbsoluteY, 3, 7, false, (*cpu).sre},
+	0x5C: {"NOP", modeAbsoluteX, 3, 4, true, (*cpu).nopRead},
+	0x5D: {"EOR", modeAbsoluteX, 3, 4, true, (*cpu).eor},
+	0x5E: {"LSR", modeAbsoluteX, 3, 7, false, (*cpu).lsr},
+	0x5F: {"SRE", modeAbsoluteX, 3, 7, false, (*cpu).sre},
+	0x60: {"RTS", modeImplied, 1, 6, false, (*cpu).rts},
+	0x61: {"ADC", modeIndexedIndirect, 2, 6, false, (*cpu).adc},
+	0x62: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x63: {"RRA", modeIndexedIndirect, 2, 8, false, (*cpu).rra},
+	0x64: {"NOP", modeZeroPage, 2, 3, false, (*cpu).nopRead},
+	0x65: {"ADC", modeZeroPage, 2, 3, false, (*cpu).adc},
+	0x66: {"ROR", modeZeroPage, 2, 5, false, (*cpu).ror},
+	0x67: {"RRA", modeZeroPage, 2, 5, false, (*cpu).rra},
+	0x68: {"PLA", modeImplied, 1, 4, false, (*cpu).pla},
+	0x69: {"ADC", modeImmediate, 2, 2, false, (*cpu).adc},
+	0x6A: {"ROR", modeAccumulator, 1, 2, false, (*cpu).rora},
+	0x6B: {"ARR", modeImmediate, 2, 2, false, (*cpu).arr},
+	0x6C: {"JMP", modeIndirect, 3, 5, false, (*cpu).jmp},
+	0x6D: {"ADC", modeAbsolute, 3, 4, false, (*cpu).adc},
+	0x6E: {"ROR", modeAbsolute, 3, 6, false, (*cpu).ror},
+	0x6F: {"RRA", modeAbsolute, 3, 6, false, (*cpu).rra},
+	0x70: {"BVS", modeRelative, 2, 2, false, (*cpu).bvs},
+	0x71: {"ADC", modeIndirectIndexed, 2, 5, true, (*cpu).adc},
+	0x72: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x73: {"RRA", modeIndirectIndexed, 2, 8, false, (*cpu).rra},
+	0x74: {"NOP", modeZeroPageX, 2, 4, false, (*cpu).nopRead},
+	0x75: {"ADC", modeZeroPageX, 2, 4, false, (*cpu).adc},
+	0x76: {"ROR", modeZeroPageX, 2, 6, false, (*cpu).ror},
+	0x77: {"RRA", modeZeroPageX, 2, 6, false, (*cpu).rra},
+	0x78: {"SEI", modeImplied, 1, 2, false, (*cpu).sei},
+	0x79: {"ADC", modeAbsoluteY, 3, 4, true, (*cpu).adc},
+	0x7A: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0x7B: {"RRA", modeAbsoluteY, 3, 7, false, (*cpu).rra},
+	0x7C: {"NOP", modeAbsoluteX, 3, 4, true, (*cpu).nopRead},
+	0x7D: {"ADC", modeAbsoluteX, 3, 4, true, (*cpu).adc},
+	0x7E: {"ROR", modeAbsoluteX, 3, 7, false, (*cpu).ror},
+	0x7F: {"RRA", modeAbsoluteX, 3, 7, false, (*cpu).rra},
+	0x80: {"NOP", modeImmediate, 2, 2, false, (*cpu).nopRead},
+	0x81: {"STA", modeIndexedIndirect, 2, 6, false, (*cpu).sta},
+	0x82: {"NOP", modeImmediate, 2, 2, false, (*cpu).nopRead},
+	0x83: {"SAX", modeIndexedIndirect, 2, 6, false, (*cpu).sax},
+	0x84: {"STY", modeZeroPage, 2, 3, false, (*cpu).sty},
+	0x85: {"STA", modeZeroPage, 2, 3, false, (*cpu).sta},
+	0x86: {"STX", modeZeroPage, 2, 3, false, (*cpu).stx},
+	0x87: {"SAX", modeZeroPage, 2, 3, false, (*cpu).sax},
+	0x88: {"DEY", modeImplied, 1, 2, false, (*cpu).dey},
+	0x89: {"NOP", modeImmediate, 2, 2, false, (*cpu).nopRead},
+	0x8A: {"TXA", modeImplied, 1, 2, false, (*cpu).txa},
+	0x8B: {"XAA", modeImmediate, 2, 2, false, (*cpu).xaa},
+	0x8C: {"STY", modeAbsolute, 3, 4, false, (*cpu).sty},
+	0x8D: {"STA", modeAbsolute, 3, 4, false, (*cpu).sta},
+	0x8E: {"STX", modeAbsolute, 3, 4, false, (*cpu).stx},
+	0x8F: {"SAX", modeAbsolute, 3, 4, false, (*cpu).sax},
+	0x90: {"BCC", modeRelative, 2, 2, false, (*cpu).bcc},
+	0x91: {"STA", modeIndirectIndexed, 2, 6, false, (*cpu).sta},
+	0x92: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0x93: {"SHA", modeIndirectIndexed, 2, 6, false, (*cpu).sha},
+	0x94: {"STY", modeZeroPageX, 2, 4, false, (*cpu).sty},
+	0x95: {"STA", modeZeroPageX, 2, 4, false, (*cpu).sta},
+	0x96: {"STX", modeZeroPageY, 2, 4, false, (*cpu).stx},
+	0x97: {"SAX", modeZeroPageY, 2, 4, false, (*cpu).sax},
+	0x98: {"TYA", modeImplied, 1, 2, false, (*cpu).tya},
+	0x99: {"STA", modeAbsoluteY, 3, 5, false, (*cpu).sta},
+	0x9A: {"TXS", modeImplied, 1, 2, false, (*cpu).txs},
+	0x9B: {"TAS", modeAbsoluteY, 3, 5, false, (*cpu).tas},
+	0x9C: {"SHY", modeAbsoluteX, 3, 5, false, (*cpu).shy},
+	0x9D: {"STA", modeAbsoluteX, 3, 5, false, (*cpu).sta},
+	0x9E: {"SHX", modeAbsoluteY, 3, 5, false, (*cpu).shx},
+	0x9F: {"SHA", modeAbsoluteY, 3, 5, false, (*cpu).sha},
+	0xA0: {"LDY", modeImmediate, 2, 2, false, (*cpu).ldy},
+	0xA1: {"LDA", modeIndexedIndirect, 2, 6, false, (*cpu).lda},
+	0xA2: {"LDX", modeImmediate, 2, 2, false, (*cpu).ldx},
+	0xA3: {"LAX", modeIndexedIndirect, 2, 6, false, (*cpu).lax},
+	0xA4: {"LDY", modeZeroPage, 2, 3, false, (*cpu).ldy},
+	0xA5: {"LDA", modeZeroPage, 2, 3, false, (*cpu).lda},
+	0xA6: {"LDX", modeZeroPage, 2, 3, false, (*cpu).ldx},
+	0xA7: {"LAX", modeZeroPage, 2, 3, false, (*cpu).lax},
+	0xA8: {"TAY", modeImplied, 1, 2, false, (*cpu).tay},
+	0xA9: {"LDA", modeImmediate, 2, 2, false, (*cpu).lda},
+	0xAA: {"TAX", modeImplied, 1, 2, false, (*cpu).tax},
+	0xAB: {"LXA", modeImmediate, 2, 2, false, (*cpu).lxa},
+	0xAC: {"LDY", modeAbsolute, 3, 4, false, (*cpu).ldy},
+	0xAD: {"LDA", modeAbsolute, 3, 4, false, (*cpu).lda},
+	0xAE: {"LDX", modeAbsolute, 3, 4, false, (*cpu).ldx},
+	0xAF: {"LAX", modeAbsolute, 3, 4, false, (*cpu).lax},
+	0xB0: {"BCS", modeRelative, 2, 2, false, (*cpu).bcs},
+	0xB1: {"LDA", modeIndirectIndexed, 2, 5, true, (*cpu).lda},
+	0xB2: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0xB3: {"LAX", modeIndirectIndexed, 2, 5, true, (*cpu).lax},
+	0xB4: {"LDY", modeZeroPageX, 2, 4, false, (*cpu).ldy},
+	0xB5: {"LDA", modeZeroPageX, 2, 4, false, (*cpu).lda},
+	0xB6: {"LDX", modeZeroPageY, 2, 4, false, (*cpu).ldx},
+	0xB7: {"LAX", modeZeroPageY, 2, 4, false, (*cpu).lax},
+	0xB8: {"CLV", modeImplied, 1, 2, false, (*cpu).clv},
+	0xB9: {"LDA", modeAbsoluteY, 3, 4, true, (*cpu).lda},
+	0xBA: {"TSX", modeImplied, 1, 2, false, (*cpu).tsx},
+	0xBB: {"LAS", modeAbsoluteY, 3, 4, true, (*cpu).las},
+	0xBC: {"LDY", modeAbsoluteX, 3, 4, true, (*cpu).ldy},
+	0xBD: {"LDA", modeAbsoluteX, 3, 4, true, (*cpu).lda},
+	0xBE: {"LDX", modeAbsoluteY, 3, 4, true, (*cpu).ldx},
+	0xBF: {"LAX", modeAbsoluteY, 3, 4, true, (*cpu).lax},
+	0xC0: {"CPY", modeImmediate, 2, 2, false, (*cpu).cpy},
+	0xC1: {"CMP", modeIndexedIndirect, 2, 6, false, (*cpu).cmp},
+	0xC2: {"NOP", modeImmediate, 2, 2, false, (*cpu).nopRead},
+	0xC3: {"DCP", modeIndexedIndirect, 2, 8, false, (*cpu).dcp},
+	0xC4: {"CPY", modeZeroPage, 2, 3, false, (*cpu).cpy},
+	0xC5: {"CMP", modeZeroPage, 2, 3, false, (*cpu).cmp},
+	0xC6: {"DEC", modeZeroPage, 2, 5, false, (*cpu).dec},
+	0xC7: {"DCP", modeZeroPage, 2, 5, false, (*cpu).dcp},
+	0xC8: {"INY", modeImplied, 1, 2, false, (*cpu).iny},
+	0xC9: {"CMP", modeImmediate, 2, 2, false, (*cpu).cmp},
+	0xCA: {"DEX", modeImplied, 1, 2, false, (*cpu).dex},
+	0xCB: {"AXS", modeImmediate, 2, 2, false, (*cpu).axs},
+	0xCC: {"CPY", modeAbsolute, 3, 4, false, (*cpu).cpy},
+	0xCD: {"CMP", modeAbsolute, 3, 4, false, (*cpu).cmp},
+	0xCE: {"DEC", modeAbsolute, 3, 6, false, (*cpu).dec},
+	0xCF: {"DCP", modeAbsolute, 3, 6, false, (*cpu).dcp},
+	0xD0: {"BNE", modeRelative, 2, 2, false, (*cpu).bne},
+	0xD1: {"CMP", modeIndirectIndexed, 2, 5, true, (*cpu).cmp},
+	0xD2: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0xD3: {"DCP", modeIndirectIndexed, 2, 8, false, (*cpu).dcp},
+	0xD4: {"NOP", modeZeroPageX, 2, 4, false, (*cpu).nopRead},
+	0xD5: {"CMP", modeZeroPageX, 2, 4, false, (*cpu).cmp},
+	0xD6: {"DEC", modeZeroPageX, 2, 6, false, (*cpu).dec},
+	0xD7: {"DCP", modeZeroPageX, 2, 6, false, (*cpu).dcp},
+	0xD8: {"CLD", modeImplied, 1, 2, false, (*cpu).cld},
+	0xD9: {"CMP", modeAbsoluteY, 3, 4, true, (*cpu).cmp},
+	0xDA: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0xDB: {"DCP", modeAbsoluteY, 3, 7, false, (*cpu).dcp},
+	0xDC: {"NOP", modeAbsoluteX, 3, 4, true, (*cpu).nopRead},
+	0xDD: {"CMP", modeAbsoluteX, 3, 4, true, (*cpu).cmp},
+	0xDE: {"DEC", modeAbsoluteX, 3, 7, false, (*cpu).dec},
+	0xDF: {"DCP", modeAbsoluteX, 3, 7, false, (*cpu).dcp},
+	0xE0: {"CPX", modeImmediate, 2, 2, false, (*cpu).cpx},
+	0xE1: {"SBC", modeIndexedIndirect, 2, 6, false, (*cpu).sbc},
+	0xE2: {"NOP", modeImmediate, 2, 2, false, (*cpu).nopRead},
+	0xE3: {"ISC", modeIndexedIndirect, 2, 8, false, (*cpu).isc},
+	0xE4: {"CPX", modeZeroPage, 2, 3, false, (*cpu).cpx},
+	0xE5: {"SBC", modeZeroPage, 2, 3, false, (*cpu).sbc},
+	0xE6: {"INC", modeZeroPage, 2, 5, false, (*cpu).inc},
+	0xE7: {"ISC", modeZeroPage, 2, 5, false, (*cpu).isc},
+	0xE8: {"INX", modeImplied, 1, 2, false, (*cpu).inx},
+	0xE9: {"SBC", modeImmediate, 2, 2, false, (*cpu).sbc},
+	0xEA: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0xEB: {"SBC", modeImmediate, 2, 2, false, (*cpu).sbc},
+	0xEC: {"CPX", modeAbsolute, 3, 4, false, (*cpu).cpx},
+	0xED: {"SBC", modeAbsolute, 3, 4, false, (*cpu).sbc},
+	0xEE: {"INC", modeAbsolute, 3, 6, false, (*cpu).inc},
+	0xEF: {"ISC", modeAbsolute, 3, 6, false, (*cpu).isc},
+	0xF0: {"BEQ", modeRelative, 2, 2, false, (*cpu).beq},
+	0xF1: {"SBC", modeIndirectIndexed, 2, 5, true, (*cpu).sbc},
+	0xF2: {"JAM", modeImplied, 1, 2, false, (*cpu).jam},
+	0xF3: {"ISC", modeIndirectIndexed, 2, 8, false, (*cpu).isc},
+	0xF4: {"NOP", modeZeroPageX, 2, 4, false, (*cpu).nopRead},
+	0xF5: {"SBC", modeZeroPageX, 2, 4, false, (*cpu).sbc},
+	0xF6: {"INC", modeZeroPageX, 2, 6, false, (*cpu).inc},
+	0xF7: {"ISC", modeZeroPageX, 2, 6, false, (*cpu).isc},
+	0xF8: {"SED", modeImplied, 1, 2, false, (*cpu).sed},
+	0xF9: {"SBC", modeAbsoluteY, 3, 4, true, (*cpu).sbc},
+	0xFA: {"NOP", modeImplied, 1, 2, false, (*cpu).nop},
+	0xFB: {"ISC", modeAbsoluteY, 3, 7, false, (*cpu).isc},
+	0xFC: {"NOP", modeAbsoluteX, 3, 4, true, (*cpu).nopRead},
+	0xFD: {"SBC", modeAbsoluteX, 3, 4, true, (*cpu).sbc},
+	0xFE: {"INC", modeAbsoluteX, 3, 7, false, (*cpu).inc},
+	0xFF: {"ISC", modeAbsoluteX, 3, 7, false, (*cpu).isc},
+}
+
+// disassemble formats the instruction at address
+// as it would be written in assembly
+func (c *cpu) disassemble(address uint16) string {
+	opcode := c.peek(address)
+	inst := &instructions[opcode]
+	if inst.handler == nil {
+		return fmt.Sprintf(".byte $%02X", opcode)
+	}
+	arg8 := c.peek(address + 1)
+	arg16 := uint16(arg8) | uint16(c.peek(address+2))<<8
+	switch inst.mode {
+	case modeAccumulator:
+		return inst.name + " A"
+	case modeAbsolute:
+		return fmt.Sprintf("%s $%04X", inst.name, arg16)
+	case modeAbsoluteX:
+		return fmt.Sprintf("%s $%04X,X", inst.name, arg16)
+	case modeAbsoluteY:
+		return fmt.Sprintf("%s $%04X,Y", inst.name, arg16)
+	case modeImmediate:
+		return fmt.Sprintf("%s #$%02X", inst.name, arg8)
+	case modeIndexedIndirect:
+		return fmt.Sprintf("%s ($%02X,X)", inst.name, arg8)
+	case modeIndirect:
+		return fmt.Sprintf("%s ($%04X)", inst.name, arg16)
+	case modeIndirectIndexed:
+		return fmt.Sprintf("%s ($%02X),Y", inst.name, arg8)
+	case modeRelative:
+		return fmt.Sprintf("%s $%04X", inst.name, address+2+uint16(int8(arg8)))
+	case modeZeroPage:
+		return fmt.Sprintf("%s $%02X", inst.name, arg8)
+	case modeZeroPageX:
+		return fmt.Sprintf("%s $%02X,X", inst.name, arg8)
+	case modeZeroPageY:
+		return fmt.Sprintf("%s $%02X,Y", inst.name, arg8)
+	}
+	return inst.name
+}
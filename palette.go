@@ -1,10 +1,197 @@
 package nes
 
-import "image/color"
+import (
+	"image/color"
+	"io"
+	"math"
 
-var palette = [64]color.RGBA{
+	"github.com/pkg/errors"
+)
+
+// the 64 colors of the default palette
+var basePalette = [64]color.RGBA{
 	{84, 84, 84, 255}, {0, 30, 116, 255}, {8, 16, 144, 255}, {48, 0, 136, 255}, {68, 0, 100, 255}, {92, 0, 48, 255}, {84, 4, 0, 255}, {60, 24, 0, 255}, {32, 42, 0, 255}, {8, 58, 0, 255}, {0, 64, 0, 255}, {0, 60, 0, 255}, {0, 50, 60, 255}, {0, 0, 0, 255}, {0, 0, 0, 255}, {0, 0, 0, 255},
 	{152, 150, 152, 255}, {8, 76, 196, 255}, {48, 50, 236, 255}, {92, 30, 228, 255}, {136, 20, 176, 255}, {160, 20, 100, 255}, {152, 34, 32, 255}, {120, 60, 0, 255}, {84, 90, 0, 255}, {40, 114, 0, 255}, {8, 124, 0, 255}, {0, 118, 40, 255}, {0, 102, 120, 255}, {0, 0, 0, 255}, {0, 0, 0, 255}, {0, 0, 0, 255},
 	{236, 238, 236, 255}, {76, 154, 236, 255}, {120, 124, 236, 255}, {176, 98, 236, 255}, {228, 84, 236, 255}, {236, 88, 180, 255}, {236, 106, 100, 255}, {212, 136, 32, 255}, {160, 170, 0, 255}, {116, 196, 0, 255}, {76, 208, 32, 255}, {56, 204, 108, 255}, {56, 180, 204, 255}, {60, 60, 60, 255}, {0, 0, 0, 255}, {0, 0, 0, 255},
 	{236, 238, 236, 255}, {168, 204, 236, 255}, {188, 188, 236, 255}, {212, 178, 236, 255}, {236, 174, 236, 255}, {236, 174, 212, 255}, {236, 180, 176, 255}, {228, 196, 144, 255}, {204, 210, 120, 255}, {180, 222, 120, 255}, {168, 226, 144, 255}, {152, 226, 180, 255}, {160, 214, 228, 255}, {160, 162, 160, 255}, {0, 0, 0, 255}, {0, 0, 0, 255},
 }
+
+// Palette maps each color the PPU outputs to RGB. It's
+// indexed by the 3 emphasis bits of PPUMASK followed by
+// the 6 bit color.
+type Palette [512]color.RGBA
+
+// DefaultPalette returns the palette used when none is given
+func DefaultPalette() *Palette {
+	p := emphasize(basePalette)
+	return &p
+}
+
+// how much emphasis dims the channels that aren't emphasized
+const emphasisAttenuation = 0.816328
+
+// emphasize builds the 8 copies of the palette for each
+// combination of the emphasis bits. Emphasizing red, green
+// or blue darkens the other two channels.
+func emphasize(base [64]color.RGBA) Palette {
+	var colors Palette
+	for emphasis := 0; emphasis < 8; emphasis++ {
+		// attenuation applied to r, g and b
+		scale := [3]float64{1, 1, 1}
+		for channel := 0; channel < 3; channel++ {
+			if emphasis&(1<<channel) == 0 {
+				continue
+			}
+			for other := range scale {
+				if other != channel {
+					scale[other] *= emphasisAttenuation
+				}
+			}
+		}
+		for i, c := range base {
+			colors[emphasis<<6|i] = color.RGBA{
+				R: byte(float64(c.R) * scale[0]),
+				G: byte(float64(c.G) * scale[1]),
+				B: byte(float64(c.B) * scale[2]),
+				A: c.A,
+			}
+		}
+	}
+	return colors
+}
+
+// ReadPalette reads a .pal file. These are 3 bytes of RGB
+// for either the 64 colors or all 512 emphasized colors.
+// With only 64 colors the emphasized colors are derived.
+func ReadPalette(r io.Reader) (*Palette, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read palette")
+	}
+	rgb := func(i int) color.RGBA {
+		return color.RGBA{data[i*3], data[i*3+1], data[i*3+2], 255}
+	}
+	var p Palette
+	switch len(data) {
+	case 64 * 3:
+		var base [64]color.RGBA
+		for i := range base {
+			base[i] = rgb(i)
+		}
+		p = emphasize(base)
+	case 512 * 3:
+		for i := range p {
+			p[i] = rgb(i)
+		}
+	default:
+		return nil, errors.Errorf("invalid palette size %d", len(data))
+	}
+	return &p, nil
+}
+
+// NTSCParameters adjust how GeneratePalette decodes the
+// NTSC signal. DefaultNTSCParameters gives a neutral palette.
+type NTSCParameters struct {
+	// Hue rotates all the colors, in degrees
+	Hue float64
+	// Saturation, Contrast and Brightness scale the
+	// color, scale the brightness and offset it
+	Saturation float64
+	Contrast   float64
+	Brightness float64
+	// Gamma of the display
+	Gamma float64
+}
+
+// DefaultNTSCParameters are the parameters of an unadjusted TV
+var DefaultNTSCParameters = NTSCParameters{
+	Saturation: 1,
+	Contrast:   1,
+	Gamma:      1.8,
+}
+
+// the voltages of the composite signal for each of the
+// 4 brightness levels, normalized so that $0D is 0 and
+// $20 is 1
+var (
+	ntscLow       = [4]float64{0.350, 0.518, 0.962, 1.550}
+	ntscHigh      = [4]float64{1.094, 1.506, 1.962, 1.962}
+	ntscBlack     = 0.518
+	ntscWhite     = 1.962
+	ntscEmphasis  = 0.746
+	ntscHueOffset = 3.9
+)
+
+// GeneratePalette builds a palette by simulating the PPU's
+// NTSC signal and decoding it the way a TV does
+func GeneratePalette(params NTSCParameters) *Palette {
+	var p Palette
+	for i := range p {
+		p[i] = ntscColor(i, params)
+	}
+	return &p
+}
+
+// ntscColor generates the signal for one cycle of the color
+// carrier, 12 samples, and decodes it to YIQ then RGB
+func ntscColor(pixel int, params NTSCParameters) color.RGBA {
+	hue := pixel & 0x0F
+	level := pixel >> 4 & 3
+	emphasis := pixel >> 6
+	// $xE and $xF are black
+	if hue > 13 {
+		level = 1
+	}
+	low, high := ntscLow[level], ntscHigh[level]
+	// $x0 is a flat grey and $xD a flat black
+	if hue == 0 {
+		low = high
+	}
+	if hue > 12 {
+		high = low
+	}
+
+	// the signal is high for half of the 12 phases
+	inPhase := func(color, phase int) bool {
+		return (color+phase)%12 < 6
+	}
+	var y, i, q float64
+	for phase := 0; phase < 12; phase++ {
+		signal := low
+		if inPhase(hue, phase) {
+			signal = high
+		}
+		// emphasis attenuates the signal during the
+		// phases of red, green or blue
+		if (emphasis&1 != 0 && inPhase(0, phase)) ||
+			(emphasis&2 != 0 && inPhase(4, phase)) ||
+			(emphasis&4 != 0 && inPhase(8, phase)) {
+			signal *= ntscEmphasis
+		}
+		signal = (signal - ntscBlack) / (ntscWhite - ntscBlack)
+		angle := math.Pi * (float64(phase) + ntscHueOffset + params.Hue/30) / 6
+		y += signal
+		i += signal * math.Cos(angle)
+		q += signal * math.Sin(angle)
+	}
+	y = y/12*params.Contrast + params.Brightness
+	i = i / 12 * params.Saturation * params.Contrast
+	q = q / 12 * params.Saturation * params.Contrast
+
+	gamma := func(v float64) byte {
+		if v <= 0 {
+			return 0
+		}
+		v = math.Pow(v, 2.2/params.Gamma) * 255
+		if v > 255 {
+			return 255
+		}
+		return byte(v)
+	}
+	return color.RGBA{
+		R: gamma(y + 0.946882*i + 0.623557*q),
+		G: gamma(y - 0.274788*i - 0.635691*q),
+		B: gamma(y - 1.108545*i + 1.709007*q),
+		A: 255,
+	}
+}
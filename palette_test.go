@@ -0,0 +1,78 @@
+package nes
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestReadPalette(t *testing.T) {
+	data := make([]byte, 64*3)
+	data[0x16*3] = 200
+	p, err := ReadPalette(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p[0x16] != (color.RGBA{200, 0, 0, 255}) {
+		t.Fatalf("$16 = %v", p[0x16])
+	}
+	// emphasizing green darkens red
+	if p[2<<6|0x16].R >= 200 {
+		t.Fatalf("emphasized $16 = %v", p[2<<6|0x16])
+	}
+
+	data = make([]byte, 512*3)
+	data[511*3+2] = 7
+	p, err = ReadPalette(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p[511] != (color.RGBA{0, 0, 7, 255}) {
+		t.Fatalf("511 = %v", p[511])
+	}
+
+	_, err = ReadPalette(bytes.NewReader(make([]byte, 100)))
+	if err == nil {
+		t.Fatal("expected an error for a bad size")
+	}
+}
+
+func TestGeneratePalette(t *testing.T) {
+	p := GeneratePalette(DefaultNTSCParameters)
+	if p[0x0D] != (color.RGBA{0, 0, 0, 255}) {
+		t.Fatalf("$0D = %v, want black", p[0x0D])
+	}
+	if c := p[0x30]; c.R < 250 || c.G < 250 || c.B < 250 {
+		t.Fatalf("$30 = %v, want white", c)
+	}
+	if c := p[0x16]; c.R < c.G || c.R < c.B {
+		t.Fatalf("$16 = %v, want red", c)
+	}
+	if c := p[0x12]; c.B < c.R || c.B < c.G {
+		t.Fatalf("$12 = %v, want blue", c)
+	}
+	if c := p[0x1A]; c.G < c.R || c.G < c.B {
+		t.Fatalf("$1A = %v, want green", c)
+	}
+
+	// rotating the hue by a third turns blue into green
+	params := DefaultNTSCParameters
+	params.Hue = 120
+	rotated := GeneratePalette(params)
+	if c := rotated[0x12]; c.G < c.R || c.G < c.B {
+		t.Fatalf("rotated $12 = %v, want green", c)
+	}
+}
+
+func TestNilPalette(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)), WithPalette(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *c.ppu.palette != *DefaultPalette() {
+		t.Fatal("expected the default palette")
+	}
+	c.SetPalette(nil)
+	c.RenderFrame(image.NewRGBA(image.Rect(0, 0, 256, 240)))
+}
@@ -1,9 +1,6 @@
 package nes
 
-import (
-	"image"
-	"log"
-)
+import "image"
 
 const (
 	statusO = 1 << (5 + iota) // sprite overflow
@@ -34,9 +31,12 @@ const (
 
 type ppu struct {
 	cart cartridge
+	// nil unless the cartridge watches the ppu bus
+	observer ppuBusObserver
 
-	// 2 screens worth of ram
-	vram [2048]byte
+	// 2 screens worth of ram plus another 2
+	// for cartridges with four screen mirroring
+	vram [4096]byte
 
 	// 32 bytes, background color is repeated
 	// every 4 bytes. 13 background colors and
@@ -58,20 +58,59 @@ type ppu struct {
 	// how many sprites did we find
 	spriteCount int
 
+	// sprite evaluation copies the up to 8 sprites on
+	// the next scanline into secondary OAM. The sprite
+	// fetches during cycles 257-320 then read from it.
+	secondaryOAM     [32]byte
+	secondaryIndices [8]byte
+	secondaryCount   int
+	spritePatternLow byte
+	// evaluation runs through OAM one step every other
+	// cycle. n is the sprite and m the byte within it.
+	evalN    byte
+	evalM    byte
+	evalDone bool
+
+	// converts the colors drawn to RGB
+	palette *Palette
+	timing  *regionTiming
+
+	// the color of each pixel drawn this frame, including
+	// emphasis, so the Zapper can sense light
+	screen [240][256]uint16
+
 	// render timing
 	cycle    int
 	scanline int
 	odd      bool
+	// running count of ppu cycles
+	clock uint64
+	// incremented at the start of each vblank. Only
+	// compared with itself so it isn't saved.
+	frame uint64
 
 	// registers
 	ctrl   byte
 	mask   byte
 	status byte
-	latch  byte
+	// the open bus latch holds the last value on the
+	// register data bus. Each bit fades to 0 when it
+	// hasn't been driven for a while.
+	latch      byte
+	latchClock [8]uint64
 
 	// data reads are buffered
 	readBuffer byte
 
+	// NMI is signalled while both vblank and ctrlV are set.
+	// The cpu polls for edges of this line and clears nmiEdge
+	// once it has seen one.
+	nmiLine bool
+	nmiEdge bool
+	// reading $2002 just before vblank starts stops
+	// the flag being set for that frame
+	suppressVBlank bool
+
 	// vram address and registers
 
 	// The 15 bit registers t and v are composed this way during rendering:
@@ -96,24 +135,92 @@ type ppu struct {
 }
 
 func newPPU(cart cartridge) *ppu {
-	return &ppu{
-		cart: cart,
+	p := &ppu{
+		cart:    cart,
+		palette: DefaultPalette(),
+		timing:  ntscTiming,
+	}
+	if observer, ok := cart.(ppuBusObserver); ok {
+		p.observer = observer
+	}
+	return p
+}
+
+func (p *ppu) syncState(s *stateStream) {
+	s.sync(&p.vram, &p.paletteTable, &p.oamAddr, &p.oamData)
+	s.sync(&p.spritePixelData, &p.spriteIndices, &p.spritePriorities, &p.spriteXPositions, &p.spriteCount)
+	s.sync(&p.secondaryOAM, &p.secondaryIndices, &p.secondaryCount, &p.spritePatternLow)
+	s.sync(&p.evalN, &p.evalM, &p.evalDone)
+	s.sync(&p.cycle, &p.scanline, &p.odd, &p.clock)
+	s.sync(&p.ctrl, &p.mask, &p.status, &p.latch, &p.latchClock, &p.readBuffer)
+	s.sync(&p.nmiLine, &p.nmiEdge, &p.suppressVBlank)
+	s.sync(&p.v, &p.t, &p.x, &p.w)
+	s.sync(&p.nameTableByte, &p.attributeTableByte, &p.patternTableLowByte, &p.patternTableHighByte, &p.backgroundPixelData)
+}
+
+// about 600ms in PPU cycles
+const ppuLatchDecay = 3221591
+
+// readLatch returns the latch after letting bits decay
+func (p *ppu) readLatch() byte {
+	for i := range p.latchClock {
+		if p.clock-p.latchClock[i] > ppuLatchDecay {
+			p.latch = resetBits(p.latch, 1<<i)
+		}
+	}
+	return p.latch
+}
+
+// refreshLatch drives the bits in mask of the latch to value
+func (p *ppu) refreshLatch(value, mask byte) {
+	p.readLatch()
+	p.latch = p.latch&^mask | value&mask
+	for i := range p.latchClock {
+		if isAnySet(mask, 1<<i) {
+			p.latchClock[i] = p.clock
+		}
 	}
 }
 
+// readRegister returns the latch for the write only registers
+// and for any bits a readable register doesn't drive
 func (p *ppu) readRegister(address uint16) byte {
 	switch address {
 	case 2:
 		// STATUS 3 bits plus the remain bits filled by the latch
-		value := (p.status & 0xE0) | p.latch
+		value := (p.status & 0xE0) | p.readLatch()&0x1F
+		// reading races with vblank being set. The cpu reads
+		// during the dot after the last one the PPU ran.
+		if p.scanline == p.timing.vblankLine {
+			switch p.cycle {
+			case 0:
+				// one dot before, the flag is never set
+				p.suppressVBlank = true
+			case 1, 2:
+				// the same dot or one after reads the flag
+				// but the NMI doesn't happen
+				p.nmiEdge = false
+			}
+		}
 		p.status = resetBits(p.status, statusV)
 		p.w = false
+		p.updateNMI()
+		p.refreshLatch(value, 0xE0)
+		return value
+	case 4:
+		value := p.oamData[p.oamAddr]
+		// secondary OAM is being cleared and reads as $FF
+		if p.renderingEnabled() && p.scanline < 240 && 1 <= p.cycle && p.cycle <= 64 {
+			value = 0xFF
+		}
+		p.refreshLatch(value, 0xFF)
 		return value
 	case 7:
 		buff := p.readBuffer
 		value := p.readByte(p.v)
+		driven := byte(0xFF)
 		// 0-3EFF is buffered
-		if p.v < 0x3F00 {
+		if p.v&0x3FFF < 0x3F00 {
 			p.readBuffer = value
 			value = buff
 		} else {
@@ -121,31 +228,44 @@ func (p *ppu) readRegister(address uint16) byte {
 			//but the data placed in it is the mirrored nametable data that
 			// would appear "underneath" the palette.
 			p.readBuffer = p.readByte(p.v - 0x1000)
+			// palette entries are 6 bits, the top
+			// 2 bits come from the latch
+			value = value&0x3F | p.readLatch()&0xC0
+			driven = 0x3F
 		}
 		if !isAnySet(p.ctrl, ctrlI) {
 			p.v += 1
 		} else {
 			p.v += 32
 		}
+		p.refreshLatch(value, driven)
 		return value
-	default:
-		log.Fatalf("invalid register read address %d", address)
 	}
-	return 0
+	return p.readLatch()
 }
 
 func (p *ppu) writeRegister(address uint16, value byte) {
 	// the latch is always written to for every write
-	p.latch = value
+	p.refreshLatch(value, 0xFF)
 	switch address {
 	case 0:
 		p.ctrl = value
 		// copy nametable select into temp vram
 		p.t = (p.t & 0xF3FF) | ((uint16(value) & ctrlN) << 10)
+		// enabling NMI during vblank triggers one
+		p.updateNMI()
 	case 1:
 		p.mask = value
 	case 3:
 		p.oamAddr = value
+	case 4:
+		// during rendering the write is ignored but
+		// the address still moves on to the next sprite
+		if p.renderingEnabled() && (p.scanline < 240 || p.scanline == p.timing.prerenderLine) {
+			p.oamAddr += 4
+			return
+		}
+		p.writeOAM(value)
 	case 5:
 		// scroll is a byte (0-255) and can be broken into 2 parts
 		// the high 5 bits are the coarse scroll and represent the
@@ -170,6 +290,10 @@ func (p *ppu) writeRegister(address uint16, value byte) {
 			p.t = (p.t & 0xFF00) | uint16(value)
 			p.v = p.t
 			p.w = false
+			// the new address is placed on the bus
+			if p.observer != nil {
+				p.observer.ppuAddress(p.v&0x3FFF, p.clock)
+			}
 		}
 	case 7:
 		p.write(p.v, value)
@@ -178,79 +302,95 @@ func (p *ppu) writeRegister(address uint16, value byte) {
 		} else {
 			p.v += 32
 		}
-	default:
-		log.Fatalf("invalid register write address %d", address)
 	}
 }
 
 // writeDMA will be called 256 times in sequence by the CPU
 func (p *ppu) writeDMA(value byte) {
+	p.writeOAM(value)
+}
+
+// writeOAM writes to OAM at oamAddr and increments it.
+// Bits 2-4 of the attribute byte don't exist.
+func (p *ppu) writeOAM(value byte) {
+	if p.oamAddr&3 == 2 {
+		value &= 0xE3
+	}
 	p.oamData[p.oamAddr] = value
 	p.oamAddr++
 }
 
+func (p *ppu) renderingEnabled() bool {
+	return isAnySet(p.mask, maskBG|maskSP)
+}
+
+// the ppu has a 14 bit address space
 func (p *ppu) readByte(address uint16) byte {
+	address &= 0x3FFF
+	if p.observer != nil {
+		p.observer.ppuAddress(address, p.clock)
+	}
 	switch {
 	case address < 0x2000:
 		return p.cart.readByte(address)
 	case address < 0x3F00:
 		return p.vram[p.cart.mirror(address)]
-	case address < 0x4000:
+	default:
 		if address%4 == 0 && address >= 16 {
 			address -= 16
 		}
 		return p.paletteTable[address%32]
-	default:
-		log.Fatalf("invalid ppu read address %04X\n", address)
 	}
-	return 0
 }
 
 func (p *ppu) write(address uint16, value byte) {
+	address &= 0x3FFF
+	if p.observer != nil {
+		p.observer.ppuAddress(address, p.clock)
+	}
 	switch {
 	case address < 0x2000:
 		p.cart.write(address, value)
 	case address < 0x3F00:
 		p.vram[p.cart.mirror(address)] = value
-	case address < 0x4000:
+	default:
 		if address%4 == 0 && address >= 16 {
 			address -= 16
 		}
 		p.paletteTable[address%32] = value
-	default:
-		log.Fatalf("invalid ppu write address %04X\n", address)
 	}
 }
 
 func (p *ppu) step(image *image.RGBA) {
 	p.cycle++
+	p.clock++
 
 	renderingEnabled := isAnySet(p.mask, maskBG|maskSP)
 
-	// On odd rendered frames there is one less tick
-	if renderingEnabled && p.cycle > 339 && p.scanline > 261 && p.odd {
-		p.cycle = 0
-		p.scanline = 0
+	// On odd rendered frames the last dot of the
+	// pre-render line is skipped
+	if renderingEnabled && p.odd && p.timing.oddFrameSkip && p.cycle == 340 && p.scanline == p.timing.prerenderLine {
+		p.cycle++
 	}
 
 	if p.cycle > 340 {
-
 		p.cycle = 0
 		p.scanline++
 
-		if p.scanline > 261 {
+		if p.scanline > p.timing.prerenderLine {
 			p.scanline = 0
+			p.odd = !p.odd
 		}
 	}
-	p.odd = !p.odd
 
 	visibleScanLine := p.scanline < 240
-	preRenderScanLine := p.scanline == 261
+	preRenderScanLine := p.scanline == p.timing.prerenderLine
 	fetchScanLine := preRenderScanLine || visibleScanLine
 
 	visibleCycle := 1 <= p.cycle && p.cycle <= 256
 	preRenderCycle := 321 <= p.cycle && p.cycle <= 336
 	fetchCycle := preRenderCycle || visibleCycle
+	spriteFetchCycle := 257 <= p.cycle && p.cycle <= 320
 
 	copyYCycle := 280 <= p.cycle && p.cycle <= 304
 
@@ -298,23 +438,65 @@ func (p *ppu) step(image *image.RGBA) {
 		if copyYCycle && preRenderScanLine {
 			p.copyY()
 		}
+		// secondary OAM is cleared during cycles 1-64 and
+		// the sprites for the next line copied into it
+		// during 65-256
+		if visibleScanLine && p.cycle > 0 && p.cycle%2 == 0 {
+			switch {
+			case p.cycle <= 64:
+				p.secondaryOAM[p.cycle/2-1] = 0xFF
+			case p.cycle <= 256:
+				p.evaluateSprite()
+			}
+		}
+		if visibleScanLine && p.cycle == 65 {
+			p.secondaryCount = 0
+			p.evalN = 0
+			p.evalM = 0
+			p.evalDone = false
+		}
 		if p.cycle == 257 {
-			if visibleScanLine {
-				p.prepareSpritePixelData()
-			} else {
-				p.spriteCount = 0
+			if !visibleScanLine {
+				p.clearSecondaryOAM()
 			}
+			p.spriteCount = p.secondaryCount
+		}
+		// the sprites for the next line are fetched 8 cycles
+		// per sprite. Empty slots still fetch tile $FF.
+		if fetchScanLine && spriteFetchCycle {
+			p.oamAddr = 0
+			slot := (p.cycle - 257) / 8
+			switch (p.cycle - 257) % 8 {
+			case 0, 2:
+				// garbage nametable fetches
+				p.getNameTableByte()
+			case 4:
+				p.spritePatternLow = p.readByte(p.spritePatternAddress(slot))
+			case 6:
+				hi := p.readByte(p.spritePatternAddress(slot) + 8)
+				p.prepareSpritePixelData(slot, p.spritePatternLow, hi)
+			}
+		}
+		// two unused nametable fetches end the line
+		if fetchScanLine && (p.cycle == 337 || p.cycle == 339) {
+			p.getNameTableByte()
 		}
 	}
 
 	// vblank
-	if p.cycle == 1 && p.scanline == 241 {
-		p.status = setBits(p.status, statusV)
+	if p.cycle == 1 && p.scanline == p.timing.vblankLine {
+		if !p.suppressVBlank {
+			p.status = setBits(p.status, statusV)
+		}
+		p.suppressVBlank = false
+		p.frame++
+		p.updateNMI()
 	}
 
-	if p.scanline == 261 && p.cycle == 1 {
+	if p.scanline == p.timing.prerenderLine && p.cycle == 1 {
 		p.status = 0
 		p.ctrl &= 0xFC
+		p.updateNMI()
 	}
 }
 
@@ -376,87 +558,148 @@ func (p *ppu) prepareBackgroundPixelData() {
 	p.backgroundPixelData |= pixelData
 }
 
-// once per visible scanline, prepare the pixel data for the
-// next scanline's 8 possible sprites
-func (p *ppu) prepareSpritePixelData() {
-	spriteCount := 0
-	for i := byte(0); i < 64; i++ {
-		tileX := p.oamData[i*4+3]
-		tileY := p.oamData[i*4]
-		tileIndex := int(p.oamData[i*4+1])
-		attr := p.oamData[i*4+2]
-		tileRow := p.scanline - int(tileY)
-		table := 0
-
-		// 16 pixel sprites
-		if isAnySet(p.ctrl, ctrlH) {
-			// first bit determines the table
-			table = tileIndex & 1
-			tileIndex = tileIndex & 0xFE
-			if attr&0x80 == 0x80 {
-				tileRow = 15 - tileRow
-			}
-			// 16 pixel sprites still are arranged
-			// as 8x8 tiles. They are just two
-			// tiles in a row.
-			if tileRow > 7 {
-				tileRow -= 8
-				tileIndex += 1
-			}
+func (p *ppu) clearSecondaryOAM() {
+	for i := range p.secondaryOAM {
+		p.secondaryOAM[i] = 0xFF
+	}
+	p.secondaryCount = 0
+}
 
-		} else {
-			if isAnySet(p.ctrl, ctrlS) {
-				table = 1
-			}
-			if attr&0x80 == 0x80 {
-				tileRow = 7 - tileRow
+// evaluateSprite runs one step of sprite evaluation,
+// looking for the up to 8 sprites that are visible
+// on the next scanline
+func (p *ppu) evaluateSprite() {
+	if p.evalDone {
+		return
+	}
+	value := p.oamData[p.evalN*4+p.evalM]
+	if p.secondaryCount < 8 {
+		// the Y coordinate is always copied, it's
+		// overwritten if the sprite isn't in range
+		p.secondaryOAM[p.secondaryCount*4+int(p.evalM)] = value
+		if p.evalM == 0 {
+			if !p.spriteInRange(value) {
+				p.nextSprite()
+				return
 			}
+			p.secondaryIndices[p.secondaryCount] = p.evalN
+		}
+		p.evalM++
+		if p.evalM == 4 {
+			p.evalM = 0
+			p.secondaryCount++
+			p.nextSprite()
 		}
+		return
+	}
+	// Once secondary OAM is full the PPU keeps looking for
+	// a 9th sprite to set the overflow flag. It's bugged and
+	// increments m along with n, so it checks the wrong byte
+	// of each sprite as if it were the Y coordinate.
+	if p.spriteInRange(value) {
+		p.status = setBits(p.status, statusO)
+		p.evalDone = true
+		return
+	}
+	p.evalM = (p.evalM + 1) & 3
+	p.nextSprite()
+}
 
-		// is the sprite visible on this scanline
-		if tileRow < 0 || tileRow > 7 {
-			continue
+// nextSprite moves evaluation to the next sprite in OAM,
+// stopping after the last one
+func (p *ppu) nextSprite() {
+	p.evalN = (p.evalN + 1) & 63
+	if p.evalN == 0 {
+		p.evalDone = true
+	}
+}
+
+// spriteInRange reports whether a sprite with the given
+// Y coordinate is visible on the next scanline
+func (p *ppu) spriteInRange(y byte) bool {
+	height := 8
+	if isAnySet(p.ctrl, ctrlH) {
+		height = 16
+	}
+	row := p.scanline - int(y)
+	return row >= 0 && row < height
+}
+
+// the pattern table address of the row of the sprite in
+// the given secondary OAM slot that is on the next line
+func (p *ppu) spritePatternAddress(slot int) uint16 {
+	tileY := p.secondaryOAM[slot*4]
+	tileIndex := int(p.secondaryOAM[slot*4+1])
+	attr := p.secondaryOAM[slot*4+2]
+	tileRow := p.scanline - int(tileY)
+	table := 0
+
+	// 16 pixel sprites
+	if isAnySet(p.ctrl, ctrlH) {
+		tileRow &= 15
+		// first bit determines the table
+		table = tileIndex & 1
+		tileIndex = tileIndex & 0xFE
+		if attr&0x80 == 0x80 {
+			tileRow = 15 - tileRow
+		}
+		// 16 pixel sprites still are arranged
+		// as 8x8 tiles. They are just two
+		// tiles in a row.
+		if tileRow > 7 {
+			tileRow -= 8
+			tileIndex += 1
 		}
 
-		tileAddress := table*0x1000 + tileIndex*16 + tileRow
-		paletteIndex := (attr & 3) << 2
-		lo := p.cart.readByte(uint16(tileAddress))
-		hi := p.cart.readByte(uint16(tileAddress + 8))
-		var value byte
-		var patternData uint32
-		for x := 0; x < 8; x++ {
-			if attr&0x40 == 0x40 {
-				value = paletteIndex | (lo & 1) | (hi&1)<<1
-				lo >>= 1
-				hi >>= 1
-			} else {
-				value = paletteIndex | ((lo & 0x80) >> 7) | ((hi & 0x80) >> 6)
-				lo <<= 1
-				hi <<= 1
-			}
-			patternData <<= 4
-			patternData |= uint32(value)
+	} else {
+		tileRow &= 7
+		if isAnySet(p.ctrl, ctrlS) {
+			table = 1
 		}
-		if spriteCount < 8 {
-			p.spritePixelData[spriteCount] = patternData
-			p.spriteIndices[spriteCount] = i
-			p.spritePriorities[spriteCount] = attr&32 == 32
-			p.spriteXPositions[spriteCount] = tileX
+		if attr&0x80 == 0x80 {
+			tileRow = 7 - tileRow
 		}
+	}
+	return uint16(table*0x1000 + tileIndex*16 + tileRow)
+}
 
-		spriteCount++
+// prepare the pixel data for one of the next
+// scanline's 8 possible sprites
+func (p *ppu) prepareSpritePixelData(slot int, lo, hi byte) {
+	if slot >= p.secondaryCount {
+		return
 	}
-	if spriteCount > 8 {
-		spriteCount = 8
-		p.status = setBits(p.status, statusO)
+	attr := p.secondaryOAM[slot*4+2]
+	paletteIndex := (attr & 3) << 2
+	var value byte
+	var patternData uint32
+	for x := 0; x < 8; x++ {
+		if attr&0x40 == 0x40 {
+			value = paletteIndex | (lo & 1) | (hi&1)<<1
+			lo >>= 1
+			hi >>= 1
+		} else {
+			value = paletteIndex | ((lo & 0x80) >> 7) | ((hi & 0x80) >> 6)
+			lo <<= 1
+			hi <<= 1
+		}
+		patternData <<= 4
+		patternData |= uint32(value)
 	}
-	p.spriteCount = spriteCount
+	p.spritePixelData[slot] = patternData
+	p.spriteIndices[slot] = p.secondaryIndices[slot]
+	p.spritePriorities[slot] = attr&32 == 32
+	p.spriteXPositions[slot] = p.secondaryOAM[slot*4+3]
 }
 
 func (p *ppu) getBackgroundPixel() byte {
 	if !isAnySet(p.mask, maskBG) {
 		return 0
 	}
+	// the left 8 pixels can be hidden
+	if p.cycle <= 8 && !isAnySet(p.mask, maskBGL) {
+		return 0
+	}
 	firstTilePixelData := p.backgroundPixelData >> 32
 
 	// because we are always shifting our prepared pixel data by one pixel
@@ -473,6 +716,9 @@ func (p *ppu) getSpritePixel() (int, byte) {
 		return 0, 0
 	}
 	x := p.cycle - 1
+	if x < 8 && !isAnySet(p.mask, maskSPL) {
+		return 0, 0
+	}
 	for i := 0; i < p.spriteCount; i++ {
 		spriteColumn := x - int(p.spriteXPositions[i])
 		if spriteColumn < 0 || spriteColumn > 7 {
@@ -511,7 +757,9 @@ func (p *ppu) renderPixel(image *image.RGBA) {
 	} else if !bg0 && sp0 {
 		pixelData = bgPixelData
 	} else {
-		if p.spriteIndices[index] == 0 {
+		// sprite 0 hit never happens on the last pixel. Clipped
+		// pixels are already transparent so can't hit either.
+		if p.spriteIndices[index] == 0 && x != 255 {
 			p.status = setBits(p.status, statusS)
 		}
 		if !p.spritePriorities[index] {
@@ -520,11 +768,28 @@ func (p *ppu) renderPixel(image *image.RGBA) {
 			pixelData = bgPixelData
 		}
 	}
-	image.SetRGBA(int(x), int(y), palette[p.paletteTable[pixelData]])
+	color := p.paletteTable[pixelData] & 0x3F
+	// greyscale keeps only the grey column of the palette
+	if isAnySet(p.mask, maskGr) {
+		color &= 0x30
+	}
+	// the emphasis bits select one of the 8 palettes
+	emphasis := p.mask >> 5
+	if p.timing.swapEmphasis {
+		emphasis = emphasis&4 | emphasis&1<<1 | emphasis&2>>1
+	}
+	emphasized := uint16(emphasis)<<6 | uint16(color)
+	p.screen[y][x] = emphasized
+	image.SetRGBA(int(x), int(y), p.palette[emphasized])
 }
 
-func (p *ppu) nmiTriggered() bool {
-	return isAnySet(p.status, statusV) && isAnySet(p.ctrl, ctrlV)
+// updateNMI records an edge when the NMI line turns on
+func (p *ppu) updateNMI() {
+	line := isAnySet(p.status, statusV) && isAnySet(p.ctrl, ctrlV)
+	if line && !p.nmiLine {
+		p.nmiEdge = true
+	}
+	p.nmiLine = line
 }
 
 // incrementX during rendering after each 8 pixels is rendered
@@ -0,0 +1,366 @@
+package nes
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+// runPPU steps p until it has just run scanline, cycle
+func runPPU(p *ppu, scanline, cycle int) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	for p.scanline != scanline || p.cycle != cycle {
+		p.step(img)
+	}
+}
+
+func TestVBlankRace(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	p.ctrl = ctrlV
+
+	// one dot before vblank the flag reads clear and is never set
+	runPPU(p, 241, 0)
+	if value := c.cpu.readByte(0x2002); value&statusV != 0 {
+		t.Fatalf("$2002 = %02X, want vblank clear", value)
+	}
+	runPPU(p, 241, 5)
+	if p.status&statusV != 0 || p.nmiEdge {
+		t.Fatal("vblank should be suppressed")
+	}
+
+	// on the same dot it reads set but there's no NMI
+	runPPU(p, 241, 1)
+	if value := c.cpu.readByte(0x2002); value&statusV == 0 {
+		t.Fatalf("$2002 = %02X, want vblank set", value)
+	}
+	if p.nmiEdge {
+		t.Fatal("NMI should be suppressed")
+	}
+
+	// a few dots later it's too late to stop the NMI
+	runPPU(p, 0, 0)
+	runPPU(p, 241, 3)
+	c.cpu.readByte(0x2002)
+	if !p.nmiEdge {
+		t.Fatal("expected an NMI")
+	}
+}
+
+func TestVBlankPeriod(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	// with rendering off every frame is 341*262 dots
+	runPPU(p, 241, 1)
+	start := p.clock
+	for i := 0; i < 2; i++ {
+		runPPU(p, 0, 0)
+		runPPU(p, 241, 1)
+	}
+	if dots := p.clock - start; dots != 2*341*262 {
+		t.Fatalf("two frames took %d dots, want %d", dots, 2*341*262)
+	}
+
+	// the flag is cleared on dot 1 of the pre-render line
+	runPPU(p, 261, 0)
+	if p.status&statusV == 0 {
+		t.Fatal("vblank cleared early")
+	}
+	runPPU(p, 261, 1)
+	if p.status&statusV != 0 {
+		t.Fatal("vblank not cleared on the pre-render line")
+	}
+}
+
+func TestNMIAfterNextInstruction(t *testing.T) {
+	// LDA #$80; STA $2000; NOP; NOP with the NMI handler at $8020
+	c := interruptConsole(t, 0xA9, 0x80, 0x8D, 0x00, 0x20, 0xEA, 0xEA)
+	runPPU(c.ppu, 241, 10)
+	c.cpu.Step()
+	c.cpu.Step()
+	// the write is on the last cycle of STA so the NMI
+	// is seen too late to come before the first NOP
+	c.cpu.Step()
+	if c.cpu.pc != 0x8006 {
+		t.Fatalf("pc = %04X, want 8006", c.cpu.pc)
+	}
+	c.cpu.Step()
+	if c.cpu.pc != 0x8020 {
+		t.Fatalf("pc = %04X, want NMI handler", c.cpu.pc)
+	}
+}
+
+func TestNMIEnable(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	runPPU(p, 241, 10)
+	if p.nmiEdge {
+		t.Fatal("NMI while disabled")
+	}
+
+	// turning NMI on during vblank triggers it
+	c.cpu.writeByte(0x2000, ctrlV)
+	if !p.nmiEdge {
+		t.Fatal("expected an NMI")
+	}
+
+	// and it can be triggered again by toggling ctrlV
+	p.nmiEdge = false
+	c.cpu.writeByte(0x2000, ctrlV)
+	if p.nmiEdge {
+		t.Fatal("NMI without an edge")
+	}
+	c.cpu.writeByte(0x2000, 0)
+	c.cpu.writeByte(0x2000, ctrlV)
+	if !p.nmiEdge {
+		t.Fatal("expected a second NMI")
+	}
+
+	// but not outside of vblank
+	p.nmiEdge = false
+	c.cpu.writeByte(0x2000, 0)
+	runPPU(p, 10, 0)
+	c.cpu.writeByte(0x2000, ctrlV)
+	if p.nmiEdge {
+		t.Fatal("NMI outside of vblank")
+	}
+}
+
+func TestOAMData(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cpu.writeByte(0x2003, 0x10)
+	for _, value := range []byte{0x20, 0x01, 0xFF, 0x30} {
+		c.cpu.writeByte(0x2004, value)
+	}
+	c.cpu.writeByte(0x2003, 0x10)
+	// reads don't increment the address
+	if value := c.cpu.readByte(0x2004); value != 0x20 {
+		t.Fatalf("$2004 = %02X, want 20", value)
+	}
+	if value := c.cpu.readByte(0x2004); value != 0x20 {
+		t.Fatalf("$2004 = %02X, want 20", value)
+	}
+	// the attribute byte is missing bits 2-4
+	c.cpu.writeByte(0x2003, 0x12)
+	if value := c.cpu.readByte(0x2004); value != 0xE3 {
+		t.Fatalf("attribute = %02X, want E3", value)
+	}
+
+	// writes while rendering only bump the address to the next sprite
+	c.ppu.mask = maskBG
+	c.ppu.scanline = 100
+	c.cpu.writeByte(0x2003, 0x11)
+	c.cpu.writeByte(0x2004, 0x55)
+	if c.ppu.oamAddr != 0x15 || c.ppu.oamData[0x11] != 0x01 {
+		t.Fatalf("oamAddr = %02X, OAM = %02X", c.ppu.oamAddr, c.ppu.oamData[0x11])
+	}
+}
+
+func TestOpenBus(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.cpu.writeByte(0x2003, 0x5A)
+	for _, address := range []uint16{0x2000, 0x2001, 0x2003, 0x2005, 0x2006, 0x3FF8} {
+		if value := c.cpu.readByte(address); value != 0x5A {
+			t.Fatalf("$%04X = %02X, want 5A", address, value)
+		}
+	}
+	// $2002 only drives the top 3 bits
+	c.ppu.status = statusV
+	if value := c.cpu.readByte(0x2002); value != 0x9A {
+		t.Fatalf("$2002 = %02X, want 9A", value)
+	}
+	// the bits that weren't refreshed fade away
+	c.ppu.clock += ppuLatchDecay / 2
+	c.ppu.status = statusV
+	c.cpu.readByte(0x2002)
+	c.ppu.clock += ppuLatchDecay
+	if value := c.cpu.readByte(0x2000); value != 0x80 {
+		t.Fatalf("$2000 = %02X, want 80", value)
+	}
+}
+
+func TestSpriteOverflow(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	p.mask = maskSP
+
+	evaluate := func(setup func()) {
+		for i := range p.oamData {
+			p.oamData[i] = 0xF0
+		}
+		// sprites 0-7 are on line 50
+		for i := 0; i < 8; i++ {
+			p.oamData[i*4] = 48
+		}
+		setup()
+		p.status = 0
+		runPPU(p, 50, 0)
+		runPPU(p, 50, 257)
+	}
+
+	// a 9th sprite on the line
+	evaluate(func() {
+		p.oamData[20*4] = 45
+	})
+	if p.spriteCount != 8 || p.status&statusO == 0 {
+		t.Fatalf("%d sprites, status %02X: expected overflow", p.spriteCount, p.status)
+	}
+	for i := 0; i < 8; i++ {
+		if p.secondaryIndices[i] != byte(i) || p.secondaryOAM[i*4] != 48 {
+			t.Fatal("secondary OAM doesn't hold sprites 0-7")
+		}
+	}
+
+	// after a sprite that isn't in range the tile of sprite 9
+	// is checked instead of its Y so it's missed
+	evaluate(func() {
+		p.oamData[9*4] = 45
+	})
+	if p.status&statusO != 0 {
+		t.Fatal("unexpected overflow")
+	}
+
+	// and the tile of sprite 9 being in range is a false positive
+	evaluate(func() {
+		p.oamData[9*4+1] = 45
+	})
+	if p.status&statusO == 0 {
+		t.Fatal("expected the buggy overflow")
+	}
+}
+
+func TestSpriteOverflowFlag(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	for i := range p.oamData {
+		p.oamData[i] = 0xF0
+	}
+	// 9 sprites on line 50
+	for i := 0; i < 9; i++ {
+		p.oamData[i*4] = 48
+	}
+
+	// rendering off never sets it
+	runPPU(p, 100, 0)
+	if p.status&statusO != 0 {
+		t.Fatal("overflow with rendering off")
+	}
+
+	// with only the background on sprites are still evaluated
+	p.mask = maskBG
+	runPPU(p, 101, 0)
+	runPPU(p, 100, 0)
+	if p.status&statusO == 0 {
+		t.Fatal("expected overflow with sprites disabled")
+	}
+	p.mask = 0
+
+	// it isn't cleared by reading $2002 or by vblank starting
+	c.cpu.readByte(0x2002)
+	runPPU(p, 241, 10)
+	if p.status&statusO == 0 {
+		t.Fatal("overflow cleared before the end of vblank")
+	}
+	// only by vblank ending
+	runPPU(p, 261, 1)
+	if p.status&statusO != 0 {
+		t.Fatal("overflow not cleared at the end of vblank")
+	}
+
+	// exactly 8 sprites don't set it
+	p.oamData[8*4] = 0xF0
+	p.mask = maskBG | maskSP
+	runPPU(p, 100, 0)
+	if p.status&statusO != 0 {
+		t.Fatal("overflow with 8 sprites")
+	}
+}
+
+func TestMask(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	img := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	// an opaque background and sprite 0 everywhere
+	p.scanline = 10
+	p.spriteCount = 1
+	p.spriteIndices[0] = 0
+	p.spritePixelData[0] = 0x11111111
+	p.paletteTable[0x11] = 0x16
+	render := func(x int) {
+		p.backgroundPixelData = 0x2222222222222222
+		p.spriteXPositions[0] = byte(x &^ 7)
+		p.cycle = x + 1
+		p.status = 0
+		p.renderPixel(img)
+	}
+
+	// the left 8 pixels are clipped so there's no hit
+	p.mask = maskBG | maskSP
+	render(3)
+	if p.status&statusS != 0 {
+		t.Fatal("sprite 0 hit in clipped column")
+	}
+	p.mask |= maskBGL | maskSPL
+	render(3)
+	if p.status&statusS == 0 {
+		t.Fatal("expected sprite 0 hit")
+	}
+	// never at x=255
+	render(255)
+	if p.status&statusS != 0 {
+		t.Fatal("sprite 0 hit at x=255")
+	}
+
+	// greyscale and red emphasis
+	p.mask |= maskGr | maskR
+	render(100)
+	if p.screen[10][100] != 0x50 {
+		t.Fatalf("color = %03X, want 050", p.screen[10][100])
+	}
+	if p.palette[0x50].G >= basePalette[0x10].G {
+		t.Fatal("red emphasis should darken green")
+	}
+}
+
+func TestOddFrameSkip(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := c.ppu
+	p.mask = maskBG
+	runPPU(p, 0, 0)
+	start := p.clock
+	runPPU(p, 1, 0)
+	runPPU(p, 0, 0)
+	runPPU(p, 1, 0)
+	runPPU(p, 0, 0)
+	// one of the two frames is a dot short
+	if dots := p.clock - start; dots != 2*341*262-1 {
+		t.Fatalf("two frames took %d dots, want %d", dots, 2*341*262-1)
+	}
+}
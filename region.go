@@ -0,0 +1,80 @@
+package nes
+
+// regionTiming holds everything that differs between
+// NTSC, PAL and Dendy consoles
+type regionTiming struct {
+	// the CPU (and therefore the APU) is clocked at this rate
+	cpuFrequency int
+	frameRate    float64
+
+	// PPU dots per 5 CPU cycles, 3 per cycle on NTSC
+	// and Dendy but 3.2 on PAL
+	dotsPer5Cycles int
+	// the line vblank starts on and the pre-render line
+	// which is the last one of the frame
+	vblankLine    int
+	prerenderLine int
+	// NTSC skips a dot on odd frames when rendering
+	oddFrameSkip bool
+	// PAL PPUs swap the red and green emphasis bits
+	swapEmphasis bool
+
+	// APU noise and dmc timer periods in CPU cycles
+	noisePeriods *[16]uint16
+	dmcPeriods   *[16]uint16
+	// the CPU cycles of the frame counter's steps. The
+	// fourth ends the 4 step sequence and the fifth the
+	// 5 step sequence.
+	frameSteps [5]int
+}
+
+var ntscTiming = &regionTiming{
+	cpuFrequency:   1789773,
+	frameRate:      60.0988,
+	dotsPer5Cycles: 15,
+	vblankLine:     241,
+	prerenderLine:  261,
+	oddFrameSkip:   true,
+	noisePeriods:   &noiseTable,
+	dmcPeriods:     &dmcTable,
+	frameSteps:     [5]int{7457, 14913, 22371, 29829, 37281},
+}
+
+var palTiming = &regionTiming{
+	cpuFrequency:   1662607,
+	frameRate:      50.007,
+	dotsPer5Cycles: 16,
+	vblankLine:     241,
+	prerenderLine:  311,
+	swapEmphasis:   true,
+	noisePeriods:   &palNoiseTable,
+	dmcPeriods:     &palDMCTable,
+	frameSteps:     [5]int{8313, 16627, 24939, 33253, 41565},
+}
+
+// Dendy famiclones have PAL's 312 lines but NTSC's CPU
+// to PPU ratio. The extra lines are before vblank so
+// games timed for NTSC vblank still work.
+var dendyTiming = &regionTiming{
+	cpuFrequency:   1773448,
+	frameRate:      50.0,
+	dotsPer5Cycles: 15,
+	vblankLine:     291,
+	prerenderLine:  311,
+	swapEmphasis:   true,
+	noisePeriods:   &noiseTable,
+	dmcPeriods:     &dmcTable,
+	frameSteps:     [5]int{7457, 14913, 22371, 29829, 37281},
+}
+
+// timing returns the timing for r. Multi-region
+// games run as NTSC.
+func (r Region) timing() *regionTiming {
+	switch r {
+	case RegionPAL:
+		return palTiming
+	case RegionDendy:
+		return dendyTiming
+	}
+	return ntscTiming
+}
@@ -0,0 +1,130 @@
+package nes
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// romTests are test ROMs that report through $6000. They
+// aren't in the repo; copy the suites into testdata as
+// they're distributed, or point NES_TEST_ROMS at a copy,
+// to run them. Missing ones are skipped.
+//
+// sprite_overflow_tests predate $6000 and only show their
+// result on screen, so they have to be checked by hand.
+// So does dma_sync; TestOAMDMASync checks what it relies on.
+var romTests = []string{
+	"mmc3_test_2/rom_singles/1-clocking.nes",
+	"mmc3_test_2/rom_singles/2-details.nes",
+	"mmc3_test_2/rom_singles/3-A12_clocking.nes",
+	"mmc3_test_2/rom_singles/4-scanline_timing.nes",
+	"mmc3_test_2/rom_singles/5-MMC3.nes",
+	"ppu_vbl_nmi/rom_singles/01-vbl_basics.nes",
+	"ppu_vbl_nmi/rom_singles/02-vbl_set_time.nes",
+	"ppu_vbl_nmi/rom_singles/03-vbl_clear_time.nes",
+	"ppu_vbl_nmi/rom_singles/04-nmi_control.nes",
+	"ppu_vbl_nmi/rom_singles/05-nmi_timing.nes",
+	"ppu_vbl_nmi/rom_singles/06-suppression.nes",
+	"ppu_vbl_nmi/rom_singles/07-nmi_on_timing.nes",
+	"ppu_vbl_nmi/rom_singles/08-nmi_off_timing.nes",
+	"ppu_vbl_nmi/rom_singles/09-even_odd_frames.nes",
+	"ppu_vbl_nmi/rom_singles/10-even_odd_timing.nes",
+	"instr_test-v5/rom_singles/01-basics.nes",
+	"instr_test-v5/rom_singles/02-implied.nes",
+	"instr_test-v5/rom_singles/03-immediate.nes",
+	"instr_test-v5/rom_singles/04-zero_page.nes",
+	"instr_test-v5/rom_singles/05-zp_xy.nes",
+	"instr_test-v5/rom_singles/06-absolute.nes",
+	"instr_test-v5/rom_singles/07-abs_xy.nes",
+	"instr_test-v5/rom_singles/08-ind_x.nes",
+	"instr_test-v5/rom_singles/09-ind_y.nes",
+	"instr_test-v5/rom_singles/10-branches.nes",
+	"instr_test-v5/rom_singles/11-stack.nes",
+	"instr_test-v5/rom_singles/12-jmp_jsr.nes",
+	"instr_test-v5/rom_singles/13-rts.nes",
+	"instr_test-v5/rom_singles/14-rti.nes",
+	"instr_test-v5/rom_singles/15-brk.nes",
+	"instr_test-v5/rom_singles/16-special.nes",
+	"cpu_exec_space/test_cpu_exec_space_ppuio.nes",
+	"cpu_exec_space/test_cpu_exec_space_apu.nes",
+	"cpu_interrupts_v2/rom_singles/1-cli_latency.nes",
+	"cpu_interrupts_v2/rom_singles/2-nmi_and_brk.nes",
+	"cpu_interrupts_v2/rom_singles/3-nmi_and_irq.nes",
+	"cpu_interrupts_v2/rom_singles/4-irq_and_dma.nes",
+	"cpu_interrupts_v2/rom_singles/5-branch_delays_irq.nes",
+	"cpu_dummy_reads.nes",
+	"cpu_dummy_writes/cpu_dummy_writes_oam.nes",
+	"cpu_dummy_writes/cpu_dummy_writes_ppumem.nes",
+	"sprdma_and_dmc_dma/sprdma_and_dmc_dma.nes",
+	"sprdma_and_dmc_dma/sprdma_and_dmc_dma_512.nes",
+}
+
+func TestROMs(t *testing.T) {
+	dir := os.Getenv("NES_TEST_ROMS")
+	if dir == "" {
+		dir = "testdata"
+	}
+	for _, name := range romTests {
+		t.Run(name, func(t *testing.T) {
+			file, err := os.Open(filepath.Join(dir, name))
+			if os.IsNotExist(err) {
+				t.Skip("not in " + dir)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			c, err := NewConsole(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result, message := runTestROM(t, c); result != 0 {
+				t.Fatalf("result %d: %s", result, message)
+			}
+		})
+	}
+}
+
+// runTestROM runs c until the ROM writes its result to
+// $6000 and returns it with the message at $6004. While
+// running $6000 is $80, or $81 when the ROM wants to be
+// reset, and $6001-$6003 hold DE B0 61.
+func runTestROM(t *testing.T, c *Console) (byte, string) {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	reset := 0
+	// a minute is more than any of them take
+	for frame := 0; frame < 60*60; frame++ {
+		c.RenderFrame(img)
+		if c.Halted() {
+			t.Fatal(c.Err())
+		}
+		if c.cpu.peek(0x6001) != 0xDE || c.cpu.peek(0x6002) != 0xB0 || c.cpu.peek(0x6003) != 0x61 {
+			continue
+		}
+		switch status := c.cpu.peek(0x6000); {
+		case status == 0x81:
+			// the reset has to come at least 100ms later
+			if reset == 0 {
+				reset = frame + 6
+			} else if frame == reset {
+				c.cpu.reset()
+			}
+		case status < 0x80:
+			var message []byte
+			for address := uint16(0x6004); address < 0x8000; address++ {
+				b := c.cpu.peek(address)
+				if b == 0 {
+					break
+				}
+				message = append(message, b)
+			}
+			return status, string(message)
+		default:
+			reset = 0
+		}
+	}
+	t.Fatal("no result after a minute")
+	return 0, ""
+}
@@ -0,0 +1,51 @@
+package nes
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Every save state starts with ASCII NESS
+const stateMagic = 0x5353454e
+
+// stateVersion is bumped whenever the layout of
+// any component's state changes
+const stateVersion = 1
+
+// stateStream either saves or restores the values it is
+// given depending on whether it wraps a writer or a reader.
+// This way each component only lists its state once, in
+// the same order for both directions.
+type stateStream struct {
+	w   io.Writer
+	r   io.Reader
+	err error
+}
+
+// sync saves or restores each value. Values must be pointers
+// to fixed size data, *int, or []int. ints are stored as
+// 64 bits. Slices of bytes are restored in place so they must
+// already be the right length.
+func (s *stateStream) sync(values ...interface{}) {
+	for _, value := range values {
+		if s.err != nil {
+			return
+		}
+		switch v := value.(type) {
+		case *int:
+			i := int64(*v)
+			s.sync(&i)
+			*v = int(i)
+		case []int:
+			for i := range v {
+				s.sync(&v[i])
+			}
+		default:
+			if s.w != nil {
+				s.err = binary.Write(s.w, binary.LittleEndian, v)
+			} else {
+				s.err = binary.Read(s.r, binary.LittleEndian, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package nes
+
+import (
+	"bytes"
+	"image"
+	"os"
+	"testing"
+)
+
+func TestSaveState(t *testing.T) {
+	file, err := os.Open("./nestest.nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	c, err := NewConsole(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	for i := 0; i < 10; i++ {
+		c.RenderFrame(frame)
+	}
+
+	var state bytes.Buffer
+	if err := c.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	saved := state.Bytes()
+
+	// run ahead pressing buttons to change the state
+	run := func() ([]byte, []byte) {
+		c.SetJoypad(Player1, ButtonStart, true)
+		for i := 0; i < 30; i++ {
+			c.RenderFrame(frame)
+		}
+		c.SetJoypad(Player1, ButtonStart, false)
+		var after bytes.Buffer
+		if err := c.SaveState(&after); err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte(nil), frame.Pix...), after.Bytes()
+	}
+	pix1, state1 := run()
+
+	if err := c.LoadState(bytes.NewReader(saved)); err != nil {
+		t.Fatal(err)
+	}
+	pix2, state2 := run()
+
+	if !bytes.Equal(pix1, pix2) {
+		t.Fatal("frames differ after loading state")
+	}
+	if !bytes.Equal(state1, state2) {
+		t.Fatal("states differ after loading state")
+	}
+
+	// a truncated state leaves the console untouched
+	if err := c.LoadState(bytes.NewReader(saved[:len(saved)/2])); err == nil {
+		t.Fatal("expected an error loading a truncated state")
+	}
+	var after bytes.Buffer
+	if err := c.SaveState(&after); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(after.Bytes(), state2) {
+		t.Fatal("truncated state modified the console")
+	}
+}
+
+func TestLoadStateAfterHalt(t *testing.T) {
+	// 3 NOPs then a JAM opcode
+	c, err := NewConsole(bytes.NewReader(testROM(0, 0xEA, 0xEA, 0xEA, 0x02)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var state bytes.Buffer
+	if err := c.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	frame := image.NewRGBA(image.Rect(0, 0, 256, 240))
+	c.RenderFrame(frame)
+	if !c.Halted() {
+		t.Fatal("expected the console to halt")
+	}
+
+	if err := c.LoadState(&state); err != nil {
+		t.Fatal(err)
+	}
+	if c.Halted() || c.cpu.pc != 0x8000 {
+		t.Fatalf("halted = %v at %04X after loading", c.Halted(), c.cpu.pc)
+	}
+	c.RenderFrame(frame)
+	if c.cpu.pc != 0x8003 {
+		t.Fatalf("pc = %04X, want 8003", c.cpu.pc)
+	}
+}
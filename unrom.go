@@ -1,15 +1,21 @@
 package nes
 
-import "log"
-
 type unROM struct {
 	mirrorMode byte
 	prg        []byte
 	chr        []byte
+	// boards without CHR ROM have RAM instead
+	chrRAM bool
+	// some boards have PRG RAM
+	sram []byte
 
 	prgBank byte
 }
 
+func (n *unROM) prgRAM() []byte {
+	return n.sram
+}
+
 func (n *unROM) readByte(address uint16) byte {
 	switch {
 	case address < 0x2000:
@@ -21,24 +27,40 @@ func (n *unROM) readByte(address uint16) byte {
 	case address >= 0x8000:
 		index := int(address-0x8000) + int(n.prgBank)*0x4000
 		return n.prg[index]
-	default:
-		log.Fatalf("invalid read address %04X", address)
+	case address >= 0x6000 && len(n.sram) > 0:
+		return n.sram[int(address-0x6000)%len(n.sram)]
 	}
 	return 0
 }
 
+func (n *unROM) mapped(address uint16) bool {
+	return address >= 0x8000 || address >= 0x6000 && len(n.sram) > 0
+}
+
 func (n *unROM) write(address uint16, value byte) {
 	switch {
 	case address < 0x2000:
-		n.chr[address] = value
+		if n.chrRAM {
+			n.chr[address] = value
+		}
 	case address >= 0x8000:
-		numPrg := byte(len(n.prg) / 0x4000)
-		n.prgBank = value % numPrg
-	default:
-		log.Fatalf("invalid write address %04X", address)
+		numPrg := len(n.prg) / 0x4000
+		n.prgBank = byte(int(value) % numPrg)
+	case address >= 0x6000 && len(n.sram) > 0:
+		n.sram[int(address-0x6000)%len(n.sram)] = value
 	}
 }
 
+func (n *unROM) syncState(s *stateStream) {
+	s.sync(n.chr, n.sram, &n.prgBank)
+}
+
 func (n *unROM) mirror(address uint16) uint16 {
 	return mirror(n.mirrorMode, address)
 }
+
+func (n *unROM) fault() error {
+	return nil
+}
+
+func (n *unROM) clearFault() {}
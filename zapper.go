@@ -0,0 +1,94 @@
+package nes
+
+// Zapper is the NES light gun. The frontend aims it at a
+// pixel on the screen and pulls the trigger. The gun senses
+// light when the pixels around where it is aimed were drawn
+// bright during the last few scanlines.
+type Zapper struct {
+	ppu *ppu
+
+	// where the gun is aimed, off screen when negative
+	x, y    int
+	trigger bool
+}
+
+// Zapper port bits
+const (
+	zapperNoLight = 1 << 3
+	zapperTrigger = 1 << 4
+)
+
+const (
+	// how far around the aim point the gun can see, in pixels
+	zapperRadius = 2
+	// the photodiode stays lit for about 25 scanlines after
+	// a bright pixel is drawn
+	zapperDecay = 25
+	// average of r, g and b for a pixel to count as bright
+	zapperBrightness = 0x80
+)
+
+// NewZapper creates a Zapper that senses light from this
+// console's screen. Plug it in with SetInputDevice, most
+// games expect it in Port2.
+func (c *Console) NewZapper() *Zapper {
+	return &Zapper{ppu: c.ppu, x: -1, y: -1}
+}
+
+// Aim points the gun at screen pixel x, y. Aim off the
+// screen, for example at -1, -1, to sense nothing.
+func (z *Zapper) Aim(x, y int) {
+	z.x = x
+	z.y = y
+}
+
+// SetTrigger pulls or releases the trigger
+func (z *Zapper) SetTrigger(pulled bool) {
+	z.trigger = pulled
+}
+
+// Read reports the trigger on bit 4 and whether the gun
+// doesn't see light on bit 3
+func (z *Zapper) Read() byte {
+	var value byte
+	if !z.light() {
+		value |= zapperNoLight
+	}
+	if z.trigger {
+		value |= zapperTrigger
+	}
+	return value
+}
+
+// Write does nothing, the Zapper ignores the strobe
+func (z *Zapper) Write(value byte) {}
+
+// light reports whether any pixel near where the gun is
+// aimed was drawn bright recently. Pixels the PPU hasn't
+// reached yet this frame are still from the previous one
+// and have faded.
+func (z *Zapper) light() bool {
+	p := z.ppu
+	if z.x < 0 || z.y < 0 || z.x >= 256 || z.y >= 240 {
+		return false
+	}
+	for y := z.y - zapperRadius; y <= z.y+zapperRadius; y++ {
+		if y < 0 || y >= 240 || y > p.scanline || p.scanline-y > zapperDecay {
+			continue
+		}
+		for x := z.x - zapperRadius; x <= z.x+zapperRadius; x++ {
+			if x < 0 || x >= 256 {
+				continue
+			}
+			// not drawn yet on the current scanline
+			if y == p.scanline && x >= p.cycle-1 {
+				continue
+			}
+			c := p.palette[p.screen[y][x]]
+			if (int(c.R)+int(c.G)+int(c.B))/3 >= zapperBrightness {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,42 @@
+package nes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestZapper(t *testing.T) {
+	c, err := NewConsole(bytes.NewReader(testROM(0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	z := c.NewZapper()
+	c.SetInputDevice(Port2, z)
+	z.Aim(100, 50)
+	c.cpu.bus = 0x40
+
+	// a white pixel drawn a few scanlines ago
+	c.ppu.screen[50][101] = 0x30
+	c.ppu.scanline = 55
+	if value := c.cpu.readByte(0x4017); value&zapperNoLight != 0 {
+		t.Fatalf("$4017 = %02X, expected light", value)
+	}
+
+	// the pixel hasn't been drawn yet this frame
+	c.ppu.scanline = 50
+	c.ppu.cycle = 50
+	if value := c.cpu.readByte(0x4017); value&zapperNoLight == 0 {
+		t.Fatalf("$4017 = %02X, expected no light", value)
+	}
+
+	// and it fades
+	c.ppu.scanline = 50 + zapperDecay + 3
+	if value := c.cpu.readByte(0x4017); value&zapperNoLight == 0 {
+		t.Fatalf("$4017 = %02X, expected no light", value)
+	}
+
+	z.SetTrigger(true)
+	if value := c.cpu.readByte(0x4017); value != 0x40|zapperNoLight|zapperTrigger {
+		t.Fatalf("$4017 = %02X, expected the trigger", value)
+	}
+}